@@ -15,7 +15,7 @@
 package analytics
 
 import (
-	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -32,33 +32,39 @@ func newBucket(m *manager, up uploader, tenant, dir string) (*bucket, error) {
 		tenant:   tenant,
 		dir:      dir,
 		incoming: make(chan []Record, m.sendChannelSize),
+		logger:   m.logger.WithFields(log.Fields{"tenant": tenant}),
 	}
 
-	var tempFileSpec string
-	if up.isGzipped() {
-		tempFileSpec = fmt.Sprintf("%d-*.gz", b.manager.now().Unix())
-	} else {
-		tempFileSpec = fmt.Sprintf("%d-*.txt", b.manager.now().Unix())
-	}
+	tempFileSpec := fmt.Sprintf("%d-*%s", b.manager.now().Unix(), up.compression().extension())
 
 	f, err := os.CreateTemp(b.dir, tempFileSpec)
 	if err != nil {
-		log.Errorf("AX Records lost. Can't create bucket file: %s", err)
+		b.logger.Errorf("AX Records lost. Can't create bucket file: %s", err)
 		return nil, err
 	}
 	b.w = &fileWriter{
-		file:   f,
-		writer: f,
+		file: f,
+	}
+	var out io.Writer = f
+	if m.streamUploads {
+		b.w.stream = newStreamWriter(up, tenant, f)
+		out = b.w.stream
 	}
-	if up.isGzipped() {
-		b.w.writer = gzip.NewWriter(f)
+	b.w.writer, err = newRecordWriter(out, up.compression())
+	if err != nil {
+		if b.w.stream != nil {
+			_ = b.w.stream.finish()
+		}
+		f.Close()
+		b.logger.Errorf("AX Records lost. Can't create bucket writer: %s", err)
+		return nil, err
 	}
 
 	go b.runLoop()
 	return b, nil
 }
 
-// A bucket writes analytics to a temp file
+// A bucket writes analytics to a temp file and, if streaming, to an upload
 type bucket struct {
 	manager  *manager
 	uploader uploader
@@ -67,13 +73,19 @@ type bucket struct {
 	w        *fileWriter
 	incoming chan []Record
 	wait     *sync.WaitGroup
+	logger   log.StructuredLogger
 }
 
-// write records to bucket
-func (b *bucket) write(records []Record) {
+// write records to bucket, returns ctx error if done before accepted
+func (b *bucket) write(ctx context.Context, records []Record) error {
 	if b != nil && len(records) > 0 {
-		b.incoming <- records
+		select {
+		case b.incoming <- records:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return nil
 }
 
 // close bucket
@@ -90,37 +102,44 @@ func (b *bucket) runLoop() {
 	written := 0
 	org, env, _ := getOrgAndEnvFromTenant(b.tenant)
 	promLabels := prometheus.Labels{"org": org, "env": env, "file": b.fileName()}
-	defer prometheusRecordsByFile.Delete(promLabels)
+	defer b.manager.metrics.recordsByFile.Delete(promLabels)
 	for records := range b.incoming {
 		if err := b.uploader.write(records, b.w.writer); err != nil {
-			log.Errorf("Write records to bucket: %s", err)
+			b.logger.Errorf("Write records to bucket: %s", err)
 		}
 		written = written + len(records)
-		prometheusRecordsByFile.With(promLabels).Set(float64(written))
+		b.manager.metrics.recordsByFile.With(promLabels).Set(float64(written))
 	}
 
 	if err := b.w.close(); err != nil {
-		log.Errorf("Can't close bucket file: %s", err)
+		b.logger.Errorf("Can't close bucket file: %s", err)
 	}
 
-	b.manager.stageFile(b.tenant, b.fileName(), written)
+	if b.w.stream == nil {
+		b.manager.stageFile(b.tenant, b.fileName(), written)
+	} else if err := b.w.stream.finish(); err != nil {
+		b.logger.Warnf("streaming upload of %s failed, staging: %v", b.fileName(), err)
+		b.manager.health.Failure(err)
+		b.manager.stageFile(b.tenant, b.fileName(), written)
+	} else {
+		b.manager.streamed(b.tenant, b.fileName(), written)
+	}
 
 	if b.wait != nil {
 		b.wait.Done()
 	}
-	log.Debugf("bucket closed: %s", b.fileName())
+	b.logger.Debugf("bucket closed: %s", b.fileName())
 }
 
 type fileWriter struct {
 	file   *os.File
-	writer io.Writer
+	writer io.WriteCloser
+	stream *streamWriter // nil if not streaming
 }
 
 func (w *fileWriter) close() error {
-	if gzw, ok := w.writer.(*gzip.Writer); ok {
-		if err := gzw.Close(); err != nil {
-			return fmt.Errorf("gz.Close: %s", err)
-		}
+	if err := w.writer.Close(); err != nil {
+		return fmt.Errorf("writer.Close: %s", err)
 	}
 
 	if err := w.file.Close(); err != nil {
@@ -15,6 +15,7 @@
 package analytics
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"os"
@@ -26,6 +27,15 @@ import (
 	"time"
 )
 
+func TestBucketWriteCanceled(t *testing.T) {
+	b := &bucket{incoming: make(chan []Record)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.write(ctx, []Record{{}}); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
 func TestBucket(t *testing.T) {
 
 	testDir, err := os.MkdirTemp("", "TestBucket")
@@ -77,7 +87,9 @@ func TestBucket(t *testing.T) {
 			Environment:  "test",
 		},
 	}
-	b.write(records)
+	if err := b.write(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
 
 	wait := &sync.WaitGroup{}
 	wait.Add(1)
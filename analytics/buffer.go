@@ -0,0 +1,207 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowPolicy determines how the manager reacts when BufferSizeLimit is reached.
+type OverflowPolicy int
+
+const (
+	// DropOldest removes the oldest staged files to make room for new records.
+	// Dead-lettered files count toward the limit and may be removed as well.
+	DropOldest OverflowPolicy = iota
+	// RejectNew refuses new records, SendRecords returns ErrBufferFull.
+	RejectNew
+	// Block makes SendRecords wait until there is room in the buffer.
+	Block
+)
+
+const (
+	defaultBufferCheckInterval = time.Second
+	bufferBlockPollInterval    = 100 * time.Millisecond
+)
+
+// ErrBufferFull is returned by SendRecords when BufferSizeLimit has been reached.
+var ErrBufferFull = errors.New("analytics buffer full")
+
+// ensureBufferSpace applies the OverflowPolicy if the buffer is over its limit.
+// Returns ErrBufferFull if the records should not be accepted, or ctx's error
+// if ctx is done while blocked.
+func (m *manager) ensureBufferSpace(ctx context.Context) error {
+	if m.bufferSizeLimit <= 0 || m.bufferUsage(false) < m.bufferSizeLimit {
+		return nil
+	}
+
+	switch m.overflowPolicy {
+	case RejectNew:
+		return ErrBufferFull
+
+	case Block:
+		t := time.NewTicker(bufferBlockPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.C:
+			}
+			m.bucketsLock.RLock()
+			closed := m.closed
+			m.bucketsLock.RUnlock()
+			if closed {
+				return ErrBufferFull
+			}
+			if m.bufferUsage(true) < m.bufferSizeLimit {
+				return nil
+			}
+		}
+
+	default:
+		m.dropOldest()
+	}
+	return nil
+}
+
+// dropOldest removes staged and dead-lettered files, oldest first, until the
+// buffer is under limit.
+func (m *manager) dropOldest() {
+	m.usageLock.Lock()
+	defer m.usageLock.Unlock()
+
+	files, err := m.getFilesInStaging()
+	if err != nil {
+		m.logger.Errorf("Get staged files: %v", err)
+	}
+	letters, err := m.DeadLetters()
+	if err != nil {
+		m.logger.Errorf("Get dead-letter files: %v", err)
+	}
+	for _, l := range letters {
+		files = append(files, l.File)
+	}
+	type stagedFile struct {
+		path string
+		info fs.FileInfo
+	}
+	var staged []stagedFile
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.Mode().IsRegular() {
+			staged = append(staged, stagedFile{f, fi})
+		}
+	}
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].info.ModTime().Before(staged[j].info.ModTime())
+	})
+
+	usage := m.calcBufferUsage()
+	for _, f := range staged {
+		if usage < m.bufferSizeLimit {
+			break
+		}
+		tenant := filepath.Base(filepath.Dir(f.path))
+		numRecs := countRecordsInFile(f.path)
+		if err := os.Remove(f.path); err != nil {
+			if !os.IsNotExist(err) {
+				m.fileLogger(tenant, f.path).Warnf("unable to remove file %s: %v", f.path, err)
+			}
+			continue
+		}
+		usage -= f.info.Size()
+		m.fileLogger(tenant, f.path).Warnf("analytics buffer full, dropped file: %s", f.path)
+
+		org, env, _ := getOrgAndEnvFromTenant(tenant)
+		m.metrics.recordsByFile.Delete(prometheus.Labels{"org": org, "env": env, "file": f.path})
+		m.countDropped(tenant, numRecs)
+	}
+	m.usageBytes = usage
+	m.usageChecked = time.Now()
+}
+
+// countDropped records metrics for a dropped file
+func (m *manager) countDropped(tenant string, numRecs int) {
+	org, env, _ := getOrgAndEnvFromTenant(tenant)
+	m.metrics.filesDropped.With(prometheus.Labels{"org": org, "env": env}).Inc()
+	countLabels := prometheus.Labels{"org": org, "env": env, "status": "dropped"}
+	m.metrics.recordsCount.With(countLabels).Add(float64(numRecs))
+}
+
+// bufferUsage returns the number of bytes stored under BufferPath. The value is
+// cached for bufferCheckInterval unless force is true.
+func (m *manager) bufferUsage(force bool) int64 {
+	m.usageLock.Lock()
+	defer m.usageLock.Unlock()
+	if force || time.Since(m.usageChecked) >= m.bufferCheckInterval {
+		m.usageBytes = m.calcBufferUsage()
+		m.usageChecked = time.Now()
+	}
+	return m.usageBytes
+}
+
+// calcBufferUsage walks BufferPath and sums the size of all regular files
+func (m *manager) calcBufferUsage() int64 {
+	var total int64
+	_ = filepath.WalkDir(m.bufferPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // files may come and go, skip
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				total += fi.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// countRecordsInFile counts the records in a staged file, 0 if unreadable
+func countRecordsInFile(fileName string) int {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	rr, err := newRecordReader(f)
+	if err != nil {
+		return 0
+	}
+	defer rr.Close()
+
+	count := 0
+	br := bufio.NewReader(rr)
+	for {
+		if _, err := br.ReadBytes('\n'); err != nil {
+			if err != io.EOF {
+				log.Debugf("counting records in %s: %v", fileName, err)
+			}
+			return count
+		}
+		count++
+	}
+}
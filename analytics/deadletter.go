@@ -0,0 +1,165 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A DeadLetter is an analytics file that could not be delivered.
+type DeadLetter struct {
+	// Tenant is "org~env"
+	Tenant string
+	// File is the path of the file
+	File string
+	// Size of the file in bytes
+	Size int64
+	// ModTime is when the file was last written
+	ModTime time.Time
+}
+
+func (m *manager) deadLetterEnabled() bool {
+	return m.maxUploadAttempts > 0 || m.maxUploadAge > 0
+}
+
+// undeliverable returns true if the file should no longer be retried
+func (m *manager) undeliverable(file string, attempts int) bool {
+	if m.maxUploadAttempts > 0 && attempts >= m.maxUploadAttempts {
+		return true
+	}
+	if m.maxUploadAge > 0 {
+		if fi, err := os.Stat(file); err == nil && time.Since(fi.ModTime()) >= m.maxUploadAge {
+			return true
+		}
+	}
+	return false
+}
+
+// deadLetter moves a staged file into the tenant's dead-letter dir
+func (m *manager) deadLetter(tenant, file string, numRecs int) {
+	dir := m.getDeadLetterDir(tenant)
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		m.fileLogger(tenant, file).Errorf("mkdir %s: %s", dir, err)
+		return
+	}
+	dest := filepath.Join(dir, filepath.Base(file))
+	if err := os.Rename(file, dest); err != nil {
+		if !os.IsNotExist(err) {
+			m.fileLogger(tenant, file).Errorf("can't move %s to dead-letter: %s", file, err)
+		}
+		return
+	}
+	m.fileLogger(tenant, dest).Warnf("analytics file moved to dead-letter: %s", dest)
+
+	org, env, _ := getOrgAndEnvFromTenant(tenant)
+	m.metrics.recordsByFile.Delete(prometheus.Labels{"org": org, "env": env, "file": file})
+	m.metrics.filesDeadLettered.With(prometheus.Labels{"org": org, "env": env}).Inc()
+	countLabels := prometheus.Labels{"org": org, "env": env, "status": "dead_lettered"}
+	m.metrics.recordsCount.With(countLabels).Add(float64(numRecs))
+}
+
+// DeadLetters lists the files in the dead-letter directory.
+func (m *manager) DeadLetters() ([]DeadLetter, error) {
+	tenantDirs, err := os.ReadDir(m.deadLetterDir)
+	if err != nil {
+		return nil, fmt.Errorf("ReadDir(%s): %s", m.deadLetterDir, err)
+	}
+
+	var errs error
+	var letters []DeadLetter
+	for _, tenantDir := range tenantDirs {
+		tenant := tenantDir.Name()
+		dir := m.getDeadLetterDir(tenant)
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			errs = errorset.Append(errs, fmt.Errorf("ls %s: %s", dir, err))
+			continue
+		}
+		for _, f := range files {
+			fi, err := f.Info()
+			if err != nil {
+				continue // removed
+			}
+			letters = append(letters, DeadLetter{
+				Tenant:  tenant,
+				File:    filepath.Join(dir, f.Name()),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+	}
+	return letters, errs
+}
+
+// ReplayDeadLetters moves dead-lettered files back to staging for upload.
+// If no files are passed, all dead-lettered files are replayed.
+func (m *manager) ReplayDeadLetters(files ...string) error {
+	letters, err := m.selectDeadLetters(files)
+	for _, l := range letters {
+		if e := m.prepTenant(l.Tenant); e != nil {
+			err = errorset.Append(err, e)
+			continue
+		}
+		stagedFile := filepath.Join(m.getStagingDir(l.Tenant), filepath.Base(l.File))
+		if e := os.Rename(l.File, stagedFile); e != nil {
+			err = errorset.Append(err, fmt.Errorf("can't replay %s: %s", l.File, e))
+			continue
+		}
+		m.fileLogger(l.Tenant, stagedFile).Infof("replaying dead-letter: %s", stagedFile)
+		m.upload(l.Tenant, stagedFile, countRecordsInFile(stagedFile))
+	}
+	return err
+}
+
+// PurgeDeadLetters deletes dead-lettered files.
+// If no files are passed, all dead-lettered files are deleted.
+func (m *manager) PurgeDeadLetters(files ...string) error {
+	letters, err := m.selectDeadLetters(files)
+	for _, l := range letters {
+		if e := os.Remove(l.File); e != nil && !os.IsNotExist(e) {
+			err = errorset.Append(err, fmt.Errorf("rm %s: %s", l.File, e))
+			continue
+		}
+		m.fileLogger(l.Tenant, l.File).Infof("purged dead-letter: %s", l.File)
+	}
+	return err
+}
+
+// selectDeadLetters returns the DeadLetters matching files, all if files is empty
+func (m *manager) selectDeadLetters(files []string) ([]DeadLetter, error) {
+	letters, err := m.DeadLetters()
+	if len(files) == 0 {
+		return letters, err
+	}
+	byFile := map[string]DeadLetter{}
+	for _, l := range letters {
+		byFile[l.File] = l
+	}
+	var selected []DeadLetter
+	for _, f := range files {
+		if l, ok := byFile[filepath.Clean(f)]; ok {
+			selected = append(selected, l)
+		} else {
+			err = errorset.Append(err, fmt.Errorf("not a dead-letter file: %s", f))
+		}
+	}
+	return selected, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	tm := newTestManager(t, Options{
+		MaxUploadAttempts: 1,
+	})
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.Start()
+	defer tm.Close()
+
+	send := func() {
+		if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+			t.Fatalf("SendRecords(): %s", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = tm.Flush(ctx)
+	}
+
+	// two failed uploads are dead-lettered
+	send()
+	send()
+	if f := filesIn(tm.getStagingDir(testTenant)); len(f) != 0 {
+		t.Errorf("want no staged files, got: %v", f)
+	}
+	letters, err := tm.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters(): %v", err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("want 2 dead letters, got %d: %v", len(letters), letters)
+	}
+	for _, l := range letters {
+		if l.Tenant != testTenant {
+			t.Errorf("want tenant %s, got %s", testTenant, l.Tenant)
+		}
+		if l.Size == 0 {
+			t.Errorf("want size for %s", l.File)
+		}
+	}
+
+	if err := tm.ReplayDeadLetters("not-a-file"); err == nil {
+		t.Errorf("want error for unknown file")
+	}
+
+	// replay one after the server recovers
+	tm.fs.lock.Lock()
+	tm.fs.failUpload = 0
+	tm.fs.lock.Unlock()
+	if err := tm.ReplayDeadLetters(letters[0].File); err != nil {
+		t.Fatalf("ReplayDeadLetters(): %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tm.Flush(ctx); err != nil {
+		t.Fatalf("Flush(): %v", err)
+	}
+	if got := tm.fs.uploadedRecords(testTenant); len(got) != 1 {
+		t.Errorf("want 1 record uploaded, got %d", len(got))
+	}
+
+	// purge the rest
+	if err := tm.PurgeDeadLetters(); err != nil {
+		t.Fatalf("PurgeDeadLetters(): %v", err)
+	}
+	if letters, _ = tm.DeadLetters(); len(letters) != 0 {
+		t.Errorf("want no dead letters, got: %v", letters)
+	}
+}
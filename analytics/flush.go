@@ -0,0 +1,130 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// Flush stages all open buckets and waits until all pending uploads are done
+// or ctx is done. Returns an errorset with an error for each file that failed
+// to upload while waiting and, if ctx is done first, the last error of each
+// file that is still being retried.
+func (m *manager) Flush(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	m.uploads.takeErrors() // only report errors for this flush
+
+	m.stageAllBucketsWait()
+
+	var err error
+	select {
+	case <-m.uploads.drained():
+	case <-ctx.Done():
+		err = errorset.Append(m.uploads.retryErrors(), ctx.Err())
+	}
+	return errorset.Append(m.uploads.takeErrors(), err)
+}
+
+// uploadTracker tracks pending uploads and their errors
+type uploadTracker struct {
+	lock    sync.Mutex
+	pending int
+	done    chan struct{}    // closed when pending reaches 0
+	errs    error            // of files that failed
+	retries map[string]error // file -> last error, while it is retried
+}
+
+// add a pending upload
+func (t *uploadTracker) add() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending == 0 {
+		t.done = make(chan struct{})
+	}
+	t.pending++
+}
+
+// finish a pending upload, successful or not
+func (t *uploadTracker) finish(file string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.retries, file)
+	t.pending--
+	if t.pending == 0 {
+		close(t.done)
+	}
+}
+
+// failed records the error of a file that will not be retried
+func (t *uploadTracker) failed(file string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.retries, file)
+	t.errs = errorset.Append(t.errs, err)
+}
+
+// retrying records the error of a failed attempt to upload a file that will
+// be retried, replacing any previous error for the file
+func (t *uploadTracker) retrying(file string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.retries == nil {
+		t.retries = map[string]error{}
+	}
+	t.retries[file] = err
+}
+
+// retryErrors returns the last error of each file being retried
+func (t *uploadTracker) retryErrors() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	files := make([]string, 0, len(t.retries))
+	for file := range t.retries {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var errs error
+	for _, file := range files {
+		errs = errorset.Append(errs, t.retries[file])
+	}
+	return errs
+}
+
+// takeErrors returns and clears the recorded errors
+func (t *uploadTracker) takeErrors() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	errs := t.errs
+	t.errs = nil
+	return errs
+}
+
+// drained returns a channel that is closed when there are no pending uploads
+func (t *uploadTracker) drained() <-chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return t.done
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the compression used for staged analytics files.
+type Compression int
+
+const (
+	// Gzip is supported by all analytics sinks.
+	Gzip Compression = iota
+	// Zstd may only be used with sinks that support it.
+	Zstd
+)
+
+// schemaVersion is the version of the NDJSON record format written to files.
+// Files written before versioning was introduced have no version and are
+// treated as version 0, which is otherwise identical to version 1.
+const schemaVersion = 1
+
+const schemaVersionPrefix = "apigee-ax-schema="
+
+var (
+	gzipMagic          = []byte{0x1f, 0x8b}
+	zstdMagic          = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zstdSkippableMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+)
+
+func (c Compression) String() string {
+	if c == Zstd {
+		return "zstd"
+	}
+	return "gzip"
+}
+
+// extension is the file extension for files of this compression
+func (c Compression) extension() string {
+	if c == Zstd {
+		return ".zst"
+	}
+	return ".gz"
+}
+
+// contentType is the HTTP content type for files of this compression
+func (c Compression) contentType() string {
+	if c == Zstd {
+		return "application/zstd"
+	}
+	return "application/x-gzip"
+}
+
+// newRecordWriter returns a compressing writer that records the schemaVersion.
+// For gzip, the version is in the header comment. For zstd, the version is
+// written as a skippable frame ahead of the data.
+func newRecordWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	version := fmt.Sprintf("%s%d", schemaVersionPrefix, schemaVersion)
+	switch c {
+	case Gzip:
+		gzw := gzip.NewWriter(w)
+		gzw.Comment = version
+		return gzw, nil
+	case Zstd:
+		frame := make([]byte, 8, 8+len(version))
+		copy(frame, zstdSkippableMagic)
+		binary.LittleEndian.PutUint32(frame[4:], uint32(len(version)))
+		frame = append(frame, version...)
+		if _, err := w.Write(frame); err != nil {
+			return nil, fmt.Errorf("write version: %s", err)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+}
+
+// detectCompression returns the compression indicated by the magic bytes at
+// the start of a file
+func detectCompression(magic []byte) (Compression, bool) {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return Gzip, true
+	case bytes.Equal(magic, zstdSkippableMagic), bytes.Equal(magic, zstdMagic):
+		return Zstd, true
+	}
+	return 0, false
+}
+
+// fileCompression detects the compression of file without moving its offset
+func fileCompression(file *os.File) (Compression, bool) {
+	magic := make([]byte, 4)
+	n, _ := file.ReadAt(magic, 0)
+	return detectCompression(magic[:n])
+}
+
+// recordReader decompresses a file of records
+type recordReader struct {
+	io.Reader
+	compression Compression
+	version     int
+	close       func()
+}
+
+func (r *recordReader) Close() error {
+	r.close()
+	return nil
+}
+
+// newRecordReader detects the compression and schema version of a file and
+// returns a reader for its records. Versions newer than schemaVersion are rejected.
+func newRecordReader(r io.Reader) (*recordReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && len(magic) < len(gzipMagic) {
+		return nil, fmt.Errorf("read header: %s", err)
+	}
+
+	c, ok := detectCompression(magic)
+	if !ok {
+		return nil, fmt.Errorf("unknown file format")
+	}
+	rr := &recordReader{compression: c}
+	switch c {
+	case Gzip:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %s", err)
+		}
+		rr.version = parseSchemaVersion(gzr.Comment)
+		rr.Reader = gzr
+		rr.close = func() { gzr.Close() }
+
+	case Zstd:
+		if bytes.Equal(magic, zstdSkippableMagic) {
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(br, header); err != nil {
+				return nil, fmt.Errorf("read version frame: %s", err)
+			}
+			payload := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return nil, fmt.Errorf("read version frame: %s", err)
+			}
+			rr.version = parseSchemaVersion(string(payload))
+		}
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader: %s", err)
+		}
+		rr.Reader = zr
+		rr.close = zr.Close
+	}
+
+	if rr.version > schemaVersion {
+		rr.close()
+		return nil, fmt.Errorf("unsupported schema version: %d", rr.version)
+	}
+	return rr, nil
+}
+
+// parseSchemaVersion returns the version in a header, 0 if none
+func parseSchemaVersion(header string) int {
+	if !strings.HasPrefix(header, schemaVersionPrefix) {
+		return 0
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(header, schemaVersionPrefix))
+	if err != nil {
+		return 0
+	}
+	return v
+}
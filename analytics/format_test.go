@@ -0,0 +1,95 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRecordFormats(t *testing.T) {
+	rec := Record{
+		Organization: "hi",
+		Environment:  "test",
+	}
+
+	for _, c := range []Compression{Gzip, Zstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w, err := newRecordWriter(buf, c)
+			if err != nil {
+				t.Fatalf("newRecordWriter: %v", err)
+			}
+			if err := json.NewEncoder(w).Encode(&rec); err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			rr, err := newRecordReader(buf)
+			if err != nil {
+				t.Fatalf("newRecordReader: %v", err)
+			}
+			defer rr.Close()
+			if rr.compression != c {
+				t.Errorf("want compression %s, got %s", c, rr.compression)
+			}
+			if rr.version != schemaVersion {
+				t.Errorf("want version %d, got %d", schemaVersion, rr.version)
+			}
+			recs, err := ReadRecords(rr, false)
+			if err != nil {
+				t.Fatalf("ReadRecords: %v", err)
+			}
+			if len(recs) != 1 || !reflect.DeepEqual(recs[0], rec) {
+				t.Errorf("want %v, got %v", rec, recs)
+			}
+		})
+	}
+}
+
+func TestRecordReaderVersions(t *testing.T) {
+	// written before schema versioning
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	_, _ = gzw.Write([]byte("{}\n"))
+	gzw.Close()
+	rr, err := newRecordReader(buf)
+	if err != nil {
+		t.Fatalf("newRecordReader: %v", err)
+	}
+	rr.Close()
+	if rr.version != 0 {
+		t.Errorf("want version 0, got %d", rr.version)
+	}
+
+	// written by a future version
+	buf = &bytes.Buffer{}
+	gzw = gzip.NewWriter(buf)
+	gzw.Comment = "apigee-ax-schema=99"
+	_, _ = gzw.Write([]byte("{}\n"))
+	gzw.Close()
+	if _, err := newRecordReader(buf); err == nil {
+		t.Errorf("want error for unsupported version")
+	}
+
+	if _, err := newRecordReader(bytes.NewBufferString("not compressed")); err == nil {
+		t.Errorf("want error for unknown format")
+	}
+}
@@ -16,12 +16,14 @@ package analytics
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"path"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 )
 
@@ -31,12 +33,34 @@ const (
 
 type legacyAnalytics struct {
 	client *http.Client
+	health health.Tracker
+	logger log.StructuredLogger
 }
 
 func (oa *legacyAnalytics) Start() {}
 func (oa *legacyAnalytics) Close() {}
 
+// Flush is a no-op, records are sent synchronously
+func (oa *legacyAnalytics) Flush(ctx context.Context) error { return nil }
+
+// DeadLetters is always empty, records are sent synchronously
+func (oa *legacyAnalytics) DeadLetters() ([]DeadLetter, error)      { return nil, nil }
+func (oa *legacyAnalytics) ReplayDeadLetters(files ...string) error { return nil }
+func (oa *legacyAnalytics) PurgeDeadLetters(files ...string) error  { return nil }
+
+// Health is always Ready and Degraded if the most recent send failed
+func (oa *legacyAnalytics) Health() health.Status {
+	status := oa.health.Status()
+	status.Name = "analytics"
+	return status
+}
+
 func (oa *legacyAnalytics) SendRecords(authContext *auth.Context, records []Record) error {
+	return oa.SendRecordsWithContext(context.Background(), authContext, records)
+}
+
+// SendRecordsWithContext sends records, canceling the request with ctx
+func (oa *legacyAnalytics) SendRecordsWithContext(ctx context.Context, authContext *auth.Context, records []Record) error {
 	axURL := *authContext.InternalAPI()
 	axURL.Path = path.Join(axURL.Path, fmt.Sprintf(axPath, authContext.Organization(), authContext.Environment()))
 
@@ -48,7 +72,7 @@ func (oa *legacyAnalytics) SendRecords(authContext *auth.Context, records []Reco
 	body := new(bytes.Buffer)
 	_ = json.NewEncoder(body).Encode(request)
 
-	req, err := http.NewRequest(http.MethodPost, axURL.String(), body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, axURL.String(), body)
 	if err != nil {
 		return err
 	}
@@ -56,10 +80,14 @@ func (oa *legacyAnalytics) SendRecords(authContext *auth.Context, records []Reco
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	log.Debugf("sending %d analytics records to: %s", len(records), axURL.String())
+	logger := oa.logger.WithFields(log.Fields{"org": authContext.Organization(), "env": authContext.Environment()})
+	logger.Debugf("sending %d analytics records to: %s", len(records), axURL.String())
 
 	resp, err := oa.client.Do(req)
 	if err != nil {
+		if ctx.Err() == nil {
+			oa.health.Failure(err)
+		}
 		return err
 	}
 	defer resp.Body.Close()
@@ -77,10 +105,13 @@ func (oa *legacyAnalytics) SendRecords(authContext *auth.Context, records []Reco
 
 	switch resp.StatusCode {
 	case 200:
-		log.Debugf("analytics accepted: %v", string(respBody))
+		logger.Debugf("analytics accepted: %v", string(respBody))
+		oa.health.Success()
 		return nil
 	default:
-		return fmt.Errorf("analytics rejected. status: %d, body: %s", resp.StatusCode, string(respBody))
+		err := fmt.Errorf("analytics rejected. status: %d, body: %s", resp.StatusCode, string(respBody))
+		oa.health.Failure(err)
+		return err
 	}
 }
 
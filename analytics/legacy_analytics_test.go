@@ -62,7 +62,7 @@ func TestAnalyticsSubmit(t *testing.T) {
 	}
 	context.internalAPI = baseURL
 	context.remoteServiceAPI = baseURL
-	ab := &legacyAnalytics{client: http.DefaultClient}
+	ab := &legacyAnalytics{client: http.DefaultClient, logger: log.Structured(nil)}
 	err = ab.SendRecords(authContext, []Record{axRecord})
 	if err != nil {
 		t.Fatal(err)
@@ -100,7 +100,7 @@ func TestMissingOrg(t *testing.T) {
 	}
 	context.internalAPI = baseURL
 	context.remoteServiceAPI = baseURL
-	ab := &legacyAnalytics{client: http.DefaultClient}
+	ab := &legacyAnalytics{client: http.DefaultClient, logger: log.Structured(nil)}
 	err = ab.SendRecords(authContext, []Record{axRecord})
 	if err == nil || !strings.Contains(err.Error(), "organization") {
 		t.Errorf("should get missing organization error, got: %s", err)
@@ -129,7 +129,7 @@ func TestMissingEnv(t *testing.T) {
 	}
 	context.internalAPI = baseURL
 	context.remoteServiceAPI = baseURL
-	ab := &legacyAnalytics{client: http.DefaultClient}
+	ab := &legacyAnalytics{client: http.DefaultClient, logger: log.Structured(nil)}
 	err = ab.SendRecords(authContext, []Record{axRecord})
 	if err == nil || !strings.Contains(err.Error(), "environment") {
 		t.Errorf("should get missing environment error, got: %s", err)
@@ -16,8 +16,8 @@ package analytics
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,10 +27,12 @@ import (
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // A Manager wraps all things related to analytics processing
@@ -38,12 +40,20 @@ type Manager interface {
 	Start()
 	Close()
 	SendRecords(authContext *auth.Context, records []Record) error
+	Flush(ctx context.Context) error
+	DeadLetters() ([]DeadLetter, error)
+	ReplayDeadLetters(files ...string) error
+	PurgeDeadLetters(files ...string) error
+	Health() health.Status
 }
 
 // NewManager constructs and starts a new manager. Call Close when you are done.
 func NewManager(opts Options) (Manager, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.Named("analytics")
+	}
 	if opts.LegacyEndpoint {
-		return &legacyAnalytics{client: opts.Client}, nil
+		return &legacyAnalytics{client: opts.Client, logger: opts.Logger}, nil
 	}
 
 	if opts.now == nil {
@@ -55,10 +65,13 @@ func NewManager(opts Options) (Manager, error) {
 	}
 
 	uploader := &saasUploader{
-		client:       opts.Client,
-		baseURL:      opts.BaseURL,
-		now:          opts.now,
-		isGCPManaged: opts.isGCPManaged(),
+		client:         opts.Client,
+		baseURL:        opts.BaseURL,
+		now:            opts.now,
+		isGCPManaged:   opts.isGCPManaged(),
+		compress:       opts.Compression,
+		tracerProvider: opts.TracerProvider,
+		logger:         opts.Logger,
 	}
 
 	mgr, err := newManager(uploader, opts)
@@ -83,35 +96,85 @@ func newManager(uploader uploader, opts Options) (*manager, error) {
 	if err := os.MkdirAll(sd, bufferMode); err != nil {
 		return nil, fmt.Errorf("mkdir %s: %s", sd, err)
 	}
+	// Ensure that base dead-letter dir exists
+	dd := filepath.Join(opts.BufferPath, "deadletter")
+	if err := os.MkdirAll(dd, bufferMode); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %s", dd, err)
+	}
+
+	numUploaders := opts.NumUploaders
+	if numUploaders <= 0 {
+		numUploaders = defaultNumUploaders
+	}
+
+	schema, err := newAttributeSchema(opts.AttributeSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Named("analytics")
+	}
 
 	return &manager{
-		closeStaging:       make(chan bool),
-		now:                opts.now,
-		collectionInterval: opts.CollectionInterval,
-		tempDir:            td,
-		stagingDir:         sd,
-		stagingFileLimit:   opts.StagingFileLimit,
-		buckets:            map[string]*bucket{},
-		sendChannelSize:    opts.SendChannelSize,
-		uploader:           uploader,
+		closeStaging:        make(chan bool),
+		now:                 opts.now,
+		collectionInterval:  opts.CollectionInterval,
+		bufferPath:          opts.BufferPath,
+		tempDir:             td,
+		stagingDir:          sd,
+		deadLetterDir:       dd,
+		stagingFileLimit:    opts.StagingFileLimit,
+		maxUploadAttempts:   opts.MaxUploadAttempts,
+		maxUploadAge:        opts.MaxUploadAge,
+		bufferSizeLimit:     opts.BufferSizeLimit,
+		overflowPolicy:      opts.OverflowPolicy,
+		bufferCheckInterval: defaultBufferCheckInterval,
+		schema:              schema,
+		streamUploads:       opts.StreamUploads,
+		numUploaders:        numUploaders,
+		buckets:             map[string]*bucket{},
+		sendChannelSize:     opts.SendChannelSize,
+		uploader:            uploader,
+		metrics:             newMetrics(opts.Metrics),
+		health:              &health.Tracker{Name: "analytics"},
+		logger:              logger,
 	}, nil
 }
 
 // A manager is a way for a Remote Service client to interact with Apigee's analytics platform.
 type manager struct {
-	closeStaging       chan bool
-	now                func() time.Time
-	collectionInterval time.Duration
-	tempDir            string // open files being written to
-	stagingDir         string // files staged for upload
-	stagingFileLimit   int
-	bucketsLock        sync.RWMutex
-	buckets            map[string]*bucket // dir ("org~env") -> bucket
-	sendChannelSize    int
-	closed             bool
-	uploadChan         chan<- interface{}
-	uploadersWait      sync.WaitGroup
-	uploader           uploader
+	closeStaging        chan bool
+	now                 func() time.Time
+	collectionInterval  time.Duration
+	bufferPath          string
+	tempDir             string // open files being written to
+	stagingDir          string // files staged for upload
+	deadLetterDir       string // files that could not be delivered
+	stagingFileLimit    int
+	maxUploadAttempts   int
+	maxUploadAge        time.Duration
+	bufferSizeLimit     int64
+	overflowPolicy      OverflowPolicy
+	bufferCheckInterval time.Duration
+	schema              *attributeSchema // nil if no schema
+	streamUploads       bool
+	usageLock           sync.Mutex
+	usageBytes          int64     // cached from bufferUsage()
+	usageChecked        time.Time // time of last usageBytes calc
+	bucketsLock         sync.RWMutex
+	buckets             map[string]*bucket // dir ("org~env") -> bucket
+	sendChannelSize     int
+	closed              bool
+	uploadQueue         *uploadQueue
+	numUploaders        int
+	uploadersWait       sync.WaitGroup
+	uploads             uploadTracker
+	uploader            uploader
+	metrics             *metrics
+	health              *health.Tracker
+	logger              log.StructuredLogger
 }
 
 // Options allows us to specify options for how this analytics manager will run.
@@ -120,13 +183,45 @@ type Options struct {
 	LegacyEndpoint bool
 	// BufferPath is the directory where the adapter will buffer analytics records.
 	BufferPath string
-	// StagingFileLimit is the maximum number of files stored in the staging directory.
-	// Once this is reached, the oldest files will start being removed.
+	// StagingFileLimit is the maximum number of staged files waiting for or in
+	// upload. Once this is reached, the newest waiting file of the tenant with
+	// the most waiting files is removed to make room.
 	StagingFileLimit int
+	// BufferSizeLimit is the maximum number of bytes stored under BufferPath,
+	// including dead-lettered files. Zero means no limit.
+	BufferSizeLimit int64
+	// OverflowPolicy determines what happens once BufferSizeLimit is reached.
+	OverflowPolicy OverflowPolicy
+	// Compression for uploaded files, Zstd requires a sink that supports it
+	Compression Compression
+	// MaxUploadAttempts is the number of failed uploads after which a file is
+	// moved to the dead-letter directory. Zero means retry forever.
+	MaxUploadAttempts int
+	// MaxUploadAge is how long a file may fail to upload before it is moved to
+	// the dead-letter directory. Zero means retry forever.
+	// If either is set, files overflowing StagingFileLimit are also dead-lettered.
+	MaxUploadAge time.Duration
+	// StreamUploads sends records to Apigee as they are written using a
+	// chunked upload instead of uploading staged files. Files are only staged
+	// if a stream fails. Requires a sink that accepts chunked uploads.
+	StreamUploads bool
+	// TracerProvider, if set, is used to trace uploads to Apigee
+	TracerProvider trace.TracerProvider
+	// Metrics determines where analytics metrics are registered
+	Metrics util.MetricsOptions
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
+	// AttributeSchema declares the Attributes that Records may include. If set,
+	// SendRecords rejects nonconforming Records and returns a RecordError for
+	// each. Not used with LegacyEndpoint.
+	AttributeSchema []AttributeDef
 	// Base Apigee URL (legacy saas)
 	BaseURL *url.URL
 	// Client is a configured HTTPClient
 	Client *http.Client
+	// NumUploaders is the number of concurrent uploads across all tenants.
+	// Defaults to 2.
+	NumUploaders int
 	// SendChannelSize is the size of the records channel
 	SendChannelSize int
 	// collection interval
@@ -162,15 +257,15 @@ const (
 	uapAnalyticsPath    = "/v1/organizations/%s/environments/%s/datalocation"
 	repoName            = "edge"
 	datasetType         = "api"
-	relativeFilePathFmt = "%v.api.%s.%s.%s.gz" // %timestamp.api.org.env.uuid.gz
+	relativeFilePathFmt = "%v.api.%s.%s.%s%s" // %timestamp.api.org.env.uuid.ext
 
-	// limited to 2 for now to limit upload stress
-	numUploaders = 2
+	// limited to 2 by default to limit upload stress
+	defaultNumUploaders = 2
 )
 
 // Start starts the manager.
 func (m *manager) Start() {
-	log.Infof("starting analytics manager: %s", m.tempDir)
+	m.logger.Infof("starting analytics manager: %s", m.tempDir)
 
 	// start upload channel and workers
 	errNoRetry := fmt.Errorf("analytics closed, no retry on upload")
@@ -181,19 +276,19 @@ func (m *manager) Start() {
 			return errNoRetry
 		}
 		m.bucketsLock.RUnlock()
-		log.Errorf("analytics upload: %v", err)
+		m.logger.Errorf("analytics upload: %v", err)
 		return nil
 	}
 	m.startUploader(errHandler)
 
 	// handle anything hanging around in temp or staging
 	if err := m.crashRecovery(); err != nil {
-		log.Errorf("Error(s) recovering crashed data: %s", err)
+		m.logger.Errorf("Error(s) recovering crashed data: %s", err)
 	}
 
 	go m.stagingLoop()
 
-	log.Infof("started analytics manager: %s", m.tempDir)
+	m.logger.Infof("started analytics manager: %s", m.tempDir)
 }
 
 func (m *manager) startUploader(errHandler util.ErrorFunc) {
@@ -203,55 +298,78 @@ func (m *manager) startUploader(errHandler util.ErrorFunc) {
 	canceledCtx, cancel := context.WithCancel(ctx)
 	cancel()
 
-	limit := int(math.Max(float64(m.stagingFileLimit-numUploaders), 1))
-	send, receive, overflow := util.NewReservoir(limit)
-	m.uploadChan = send
+	// handle overflow
+	overflow := func(job uploadJob) {
+		defer m.uploads.finish(job.file)
+		if err := job.work(canceledCtx); err != nil {
+			m.logger.Errorf("handling overflow: %v", err)
+		}
+	}
+	m.uploadQueue = newUploadQueue(m.stagingFileLimit, util.DefaultExponentialBackoff(), overflow)
 
 	// handle uploads
-	for i := 0; i < numUploaders; i++ {
-		l := util.Looper{
-			Backoff: util.DefaultExponentialBackoff(),
-		}
+	for i := 0; i < m.numUploaders; i++ {
 		m.uploadersWait.Add(1)
 		go func() {
 			defer m.uploadersWait.Done()
 
-			for work := range receive {
-				if err := l.Run(ctx, work.(util.WorkFunc), errHandler); err != nil {
-					log.Errorf("looper run: %v", err)
+			for job := range m.uploadQueue.out {
+				err := job.work(ctx)
+				if err != nil {
+					if errHandler(err) == nil {
+						m.uploads.retrying(job.file, err)
+						m.uploadQueue.done(job, true)
+						continue
+					}
+					m.uploads.failed(job.file, err)
 				}
+				m.uploadQueue.done(job, false)
+				m.uploads.finish(job.file)
 			}
 		}()
 	}
-
-	m.uploadersWait.Add(1)
-	// handle overflow
-	go func() {
-		defer m.uploadersWait.Done()
-
-		for dropped := range overflow {
-			work := dropped.(util.WorkFunc)
-			go func() {
-				if err := work(canceledCtx); err != nil {
-					log.Errorf("handling overflow: %v", err)
-				}
-			}()
-		}
-	}()
 }
 
 func (m *manager) upload(tenant, file string, numRecs int) {
+	attempts := 0
 	prometheusInstrumentedWork := func(ctx context.Context) error {
+		if ctx.Err() != nil && m.deadLetterEnabled() { // overflow, keep file
+			m.deadLetter(tenant, file, numRecs)
+			return nil
+		}
 		err := m.uploader.workFunc(tenant, file)(ctx)
+		if ctx.Err() != nil { // overflow, file was dropped
+			m.countDropped(tenant, numRecs)
+			return err
+		}
+		if errors.Is(err, errFileMissing) { // dropped, already counted
+			return nil
+		}
+		m.health.Record(err)
 		if err == nil {
 			org, env, _ := getOrgAndEnvFromTenant(tenant)
-			prometheusRecordsByFile.Delete(prometheus.Labels{"org": org, "env": env, "file": file})
+			m.metrics.recordsByFile.Delete(prometheus.Labels{"org": org, "env": env, "file": file})
 			countLabels := prometheus.Labels{"org": org, "env": env, "status": "uploaded"}
-			prometheusRecordsCount.With(countLabels).Add(float64(numRecs))
+			m.metrics.recordsCount.With(countLabels).Add(float64(numRecs))
+			return nil
+		}
+		attempts++
+		if m.undeliverable(file, attempts) {
+			m.fileLogger(tenant, file).Errorf("analytics upload failed %d times: %v", attempts, err)
+			m.uploads.failed(file, err)
+			m.deadLetter(tenant, file, numRecs)
+			return nil
 		}
 		return err
 	}
-	m.uploadChan <- prometheusInstrumentedWork
+	m.uploads.add()
+	m.uploadQueue.in <- uploadJob{tenant: tenant, file: file, work: prometheusInstrumentedWork}
+}
+
+// Health is always Ready as records are buffered locally. It is Degraded if
+// the most recent upload to Apigee failed.
+func (m *manager) Health() health.Status {
+	return m.health.Status()
 }
 
 // Close shuts down the manager
@@ -259,7 +377,7 @@ func (m *manager) Close() {
 	if m == nil {
 		return
 	}
-	log.Infof("closing analytics manager: %s", m.tempDir)
+	m.logger.Infof("closing analytics manager: %s", m.tempDir)
 
 	m.bucketsLock.Lock()
 	m.closed = true
@@ -269,10 +387,10 @@ func (m *manager) Close() {
 
 	// force stage and upload
 	m.stageAllBucketsWait()
-	close(m.uploadChan)
+	close(m.uploadQueue.in)
 	m.uploadersWait.Wait()
 
-	log.Infof("closed analytics manager: %s", m.tempDir)
+	m.logger.Infof("closed analytics manager: %s", m.tempDir)
 }
 
 // stagingLoop periodically closes and sweeps open buckets to staging
@@ -284,48 +402,84 @@ func (m *manager) stagingLoop() {
 			m.stageAllBucketsWait()
 
 		case <-m.closeStaging:
-			log.Debugf("analytics staging loop closed: %s", m.tempDir)
+			m.logger.Debugf("analytics staging loop closed: %s", m.tempDir)
 			return
 		}
 	}
 }
 
-// SendRecords is called by Mixer, spools records for sending
-func (m *manager) SendRecords(ctx *auth.Context, incoming []Record) error {
+// SendRecords is called by Mixer, spools records for sending.
+// If an AttributeSchema is configured, valid records are still sent and
+// an error containing a RecordError for each invalid record is returned.
+func (m *manager) SendRecords(authContext *auth.Context, incoming []Record) error {
+	return m.SendRecordsWithContext(context.Background(), authContext, incoming)
+}
+
+// SendRecordsWithContext is SendRecords, but returns ctx's error if ctx is
+// done before records are accepted, such as while waiting for a full bucket
+// or, with the Block OverflowPolicy, for space in the buffer.
+func (m *manager) SendRecordsWithContext(ctx context.Context, authContext *auth.Context, incoming []Record) error {
 	if m == nil || len(incoming) == 0 {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Validate the records
 	now := m.now()
 	records := make([]Record, 0, len(incoming))
-	promLabels := prometheus.Labels{"org": ctx.Organization(), "env": ctx.Environment()}
-	localRecCount := prometheusRecordsCount.MustCurryWith(promLabels)
-	for _, record := range incoming {
-		record := record.EnsureFields(ctx)
-		if err := record.validate(now); err != nil {
-			log.Errorf("invalid record %#v: %s", record, err)
+	promLabels := prometheus.Labels{"org": authContext.Organization(), "env": authContext.Environment()}
+	localRecCount := m.metrics.recordsCount.MustCurryWith(promLabels)
+	var recordErrs error
+	for i, record := range incoming {
+		record := record.EnsureFields(authContext)
+		err := record.validate(now)
+		if m.schema != nil {
+			err = errorset.Append(err, m.schema.validate(record.Attributes))
+		}
+		if err != nil {
+			m.logger.Errorf("invalid record %#v: %s", record, err)
 			localRecCount.WithLabelValues("error").Inc()
+			if m.schema != nil {
+				recordErrs = errorset.Append(recordErrs, &RecordError{Index: i, Err: err})
+			}
 			continue
 		}
-		localRecCount.WithLabelValues("accepted").Inc()
 		records = append(records, record)
 	}
 
-	return m.writeToBucket(ctx, records)
+	if len(records) > 0 {
+		if err := m.ensureBufferSpace(ctx); err != nil {
+			localRecCount.WithLabelValues("rejected").Add(float64(len(records)))
+			if recordErrs != nil {
+				return errorset.Append(recordErrs, err)
+			}
+			return err
+		}
+	}
+	localRecCount.WithLabelValues("accepted").Add(float64(len(records)))
+
+	if err := m.writeToBucket(ctx, authContext, records); err != nil {
+		if recordErrs != nil {
+			return errorset.Append(recordErrs, err)
+		}
+		return err
+	}
+	return recordErrs
 }
 
-func (m *manager) writeToBucket(ctx *auth.Context, records []Record) error {
+func (m *manager) writeToBucket(ctx context.Context, authContext *auth.Context, records []Record) error {
 	if len(records) == 0 {
 		return nil
 	}
-	tenant := getTenantName(ctx.Organization(), ctx.Environment())
+	tenant := getTenantName(authContext.Organization(), authContext.Environment())
 
 	m.bucketsLock.RLock()
 	if bucket, ok := m.buckets[tenant]; ok {
-		bucket.write(records)
+		err := bucket.write(ctx, records)
 		m.bucketsLock.RUnlock()
-		return nil
+		return err
 	}
 
 	// no bucket, we'll have to work harder
@@ -346,8 +500,7 @@ func (m *manager) writeToBucket(ctx *auth.Context, records []Record) error {
 		}
 		m.buckets[tenant] = bucket
 	}
-	bucket.write(records)
-	return nil
+	return bucket.write(ctx, records)
 }
 
 // ensures tenant temp and staging dirs are created
@@ -375,6 +528,15 @@ func (m *manager) getStagingDir(tenant string) string {
 	return filepath.Join(m.stagingDir, tenant)
 }
 
+func (m *manager) getDeadLetterDir(tenant string) string {
+	return filepath.Join(m.deadLetterDir, tenant)
+}
+
+// fileLogger returns the logger with fields for tenant and file
+func (m *manager) fileLogger(tenant, file string) log.StructuredLogger {
+	return m.logger.WithFields(log.Fields{"tenant": tenant, "file": file})
+}
+
 func getTenantName(org, env string) string {
 	return fmt.Sprintf("%s~%s", org, env)
 }
@@ -387,16 +549,45 @@ func getOrgAndEnvFromTenant(tenant string) (string, string, error) {
 	return split[0], split[1], nil
 }
 
-var (
-	prometheusRecordsCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "analytics",
-		Name:      "records_count",
-		Help:      "Analytics record counts by status",
-	}, []string{"org", "env", "status"})
-
-	prometheusRecordsByFile = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "analytics",
-		Name:      "records_staged",
-		Help:      "Analytics record counts by staging file",
-	}, []string{"org", "env", "file"})
-)
+// metrics are the analytics Prometheus metrics
+type metrics struct {
+	recordsCount           *prometheus.GaugeVec
+	recordsByFile          *prometheus.GaugeVec
+	filesDropped           *prometheus.CounterVec
+	filesDeadLettered      *prometheus.CounterVec
+	recoveryDiscardedBytes *prometheus.CounterVec
+}
+
+func newMetrics(opts util.MetricsOptions) *metrics {
+	return &metrics{
+		recordsCount: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "analytics",
+			Name:      "records_count",
+			Help:      "Analytics record counts by status",
+		}, []string{"org", "env", "status"}),
+
+		recordsByFile: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "analytics",
+			Name:      "records_staged",
+			Help:      "Analytics record counts by staging file",
+		}, []string{"org", "env", "file"}),
+
+		filesDropped: opts.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "analytics",
+			Name:      "files_dropped_total",
+			Help:      "Analytics files dropped due to buffer limits",
+		}, []string{"org", "env"}),
+
+		filesDeadLettered: opts.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "analytics",
+			Name:      "files_dead_lettered_total",
+			Help:      "Analytics files moved to the dead-letter directory",
+		}, []string{"org", "env"}),
+
+		recoveryDiscardedBytes: opts.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "analytics",
+			Name:      "recovery_discarded_bytes_total",
+			Help:      "Bytes of incomplete or invalid records discarded during crash recovery",
+		}, []string{"org", "env"}),
+	}
+}
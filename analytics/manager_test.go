@@ -15,11 +15,18 @@
 package analytics
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestLegacySelect(t *testing.T) {
@@ -98,3 +105,122 @@ func TestStandardBadOptions(t *testing.T) {
 		m.Close()
 	}
 }
+
+func TestSendRecordsWithContext(t *testing.T) {
+	tm := newTestManager(t, Options{})
+	tm.Start()
+	defer tm.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, m := range []Manager{tm.manager, struct{ Manager }{tm.manager}} {
+		if err := SendRecordsWithContext(canceled, m, tm.authContext, tm.records); err != context.Canceled {
+			t.Errorf("want %v, got: %v", context.Canceled, err)
+		}
+		if err := SendRecordsWithContext(context.Background(), m, tm.authContext, tm.records); err != nil {
+			t.Errorf("SendRecordsWithContext(): %v", err)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	tm := newTestManager(t, Options{})
+	tm.Start()
+	defer tm.Close()
+
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tm.Flush(ctx); err != nil {
+		t.Fatalf("Flush(): %v", err)
+	}
+	if got := tm.fs.uploadedRecords(testTenant); len(got) != 1 {
+		t.Errorf("want 1 record uploaded, got %d", len(got))
+	}
+
+	// failed uploads are reported once ctx is done, once per file
+	tm.fs.lock.Lock()
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.fs.lock.Unlock()
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := tm.Flush(ctx)
+	if err == nil {
+		t.Fatalf("want error")
+	}
+	if !strings.Contains(err.Error(), "500 Internal Server Error") {
+		t.Errorf("want upload error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("want deadline error, got: %v", err)
+	}
+	if errs := errorset.Errors(err); len(errs) != 2 {
+		t.Errorf("want upload and deadline errors, got: %v", errs)
+	}
+}
+
+func TestFlushDeadLetterErrors(t *testing.T) {
+	tm := newTestManager(t, Options{
+		MaxUploadAttempts: 3,
+	})
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.Start()
+	defer tm.Close()
+
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := tm.Flush(ctx)
+	if errs := errorset.Errors(err); len(errs) != 1 || !strings.Contains(errs[0].Error(), "500 Internal Server Error") {
+		t.Errorf("want one upload error for the dead-lettered file, got: %v", err)
+	}
+}
+
+func TestUploadMissingFile(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	tm := newTestManager(t, Options{
+		Metrics: util.MetricsOptions{Registerer: reg},
+	})
+	tm.Start()
+	defer tm.Close()
+
+	// a file dropped from the buffer while its upload was queued
+	if err := tm.prepTenant(testTenant); err != nil {
+		t.Fatalf("prepTenant: %v", err)
+	}
+	tm.upload(testTenant, filepath.Join(tm.getStagingDir(testTenant), "dropped.json.gz"), 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tm.Flush(ctx); err != nil {
+		t.Fatalf("Flush(): %v", err)
+	}
+
+	if s := tm.Health(); !s.LastSuccess.IsZero() || s.LastError != nil {
+		t.Errorf("want no upload recorded, got %#v", s)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "analytics_records_count" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "status" && l.GetValue() == "uploaded" {
+					t.Errorf("want no uploaded records, got %v", metric.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+}
@@ -35,6 +35,9 @@ const (
 	maxAttributeValueBytes = 400
 )
 
+// recordLog is used by Records, which have no manager
+var recordLog = log.Named("analytics")
+
 // An Attribute is used to record custom Record values.
 // Name will be forced to have "dc." prefix.
 // Value will be limited to 400 bytes, truncated on rune boundary.
@@ -145,7 +148,7 @@ func (r Record) MarshalJSON() ([]byte, error) {
 	}
 	attrs := r.Attributes
 	if len(r.Attributes) > maxNumAttributes {
-		log.Debugf("truncated attributes list to max length of %d", maxNumAttributes)
+		recordLog.Debugf("truncated attributes list to max length of %d", maxNumAttributes)
 		attrs = r.Attributes[:maxNumAttributes]
 	}
 	for _, attr := range attrs {
@@ -153,7 +156,7 @@ func (r Record) MarshalJSON() ([]byte, error) {
 		val := attr.Value
 
 		if err := validateAttribute(attr); err != nil {
-			log.Debugf(err.Error())
+			recordLog.Debugf(err.Error())
 			continue
 		}
 
@@ -170,15 +173,15 @@ func (r Record) MarshalJSON() ([]byte, error) {
 		// truncate, if necessary
 		val, truncated := truncStringToBytes(val, maxAttributeValueBytes)
 		if truncated {
-			log.Debugf("truncated attribute %s to max length of %d", key, maxAttributeValueBytes)
+			recordLog.Debugf("truncated attribute %s to max length of %d", key, maxAttributeValueBytes)
 		}
 		m[key] = val
 	}
 	b, e := json.Marshal(m)
 	if e != nil {
-		log.Debugf("ax json err: %s", e)
+		recordLog.Debugf("ax json err: %s", e)
 	} else {
-		log.Debugf("ax record: %s", string(b))
+		recordLog.Debugf("ax record: %s", string(b))
 	}
 	return b, e
 }
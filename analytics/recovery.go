@@ -16,14 +16,18 @@ package analytics
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
-	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // crashRecovery cleans up the temp and staging dirs post-crash. This function
@@ -51,12 +55,14 @@ func (m *manager) crashRecovery() error {
 		stageDir := m.getStagingDir(tenant)
 
 		// put staged files in upload queue
-		stagedFiles, err := m.getFilesInStaging()
+		stagedFiles, err := os.ReadDir(stageDir)
 		if err != nil {
-			log.Errorf("Get staged files: %v", err)
+			m.logger.Errorf("Get staged files: %v", err)
 		}
 		for _, fi := range stagedFiles {
-			m.upload(tenant, fi, 0)
+			if !fi.IsDir() {
+				m.upload(tenant, filepath.Join(stageDir, fi.Name()), 0)
+			}
 		}
 
 		// recover temp to staging and upload
@@ -69,16 +75,25 @@ func (m *manager) crashRecovery() error {
 				errs = errorset.Append(errs, fmt.Errorf("create recovery file %s: %s", tempDir, err))
 				continue
 			}
-			if err := m.recoverFile(tempFile, dest); err != nil {
+			stats, err := m.recoverFile(tempFile, dest)
+			if err != nil {
 				errs = errorset.Append(errs, fmt.Errorf("recoverFile %s: %s", tempDir, err))
 				if err := os.Remove(stageFile); err != nil {
 					errs = errorset.Append(errs, fmt.Errorf("remove stage file %s: %s", tempDir, err))
 				}
 				continue
 			}
+			if stats.discardedRecords > 0 {
+				errs = errorset.Append(errs, fmt.Errorf("recoverFile %s: discarded %d bytes (%d records)",
+					tempFile, stats.discardedBytes, stats.discardedRecords))
+				org, env, _ := getOrgAndEnvFromTenant(tenant)
+				countLabels := prometheus.Labels{"org": org, "env": env, "status": "discarded"}
+				m.metrics.recordsCount.With(countLabels).Add(float64(stats.discardedRecords))
+				m.metrics.recoveryDiscardedBytes.With(prometheus.Labels{"org": org, "env": env}).Add(float64(stats.discardedBytes))
+			}
 
 			if err := os.Remove(tempFile); err != nil {
-				log.Warnf("unable to remove temp file: %s", tempFile)
+				m.logger.Warnf("unable to remove temp file: %s", tempFile)
 			}
 
 			m.upload(tenant, stageFile, 0)
@@ -87,42 +102,85 @@ func (m *manager) crashRecovery() error {
 	return errs
 }
 
-// recoverFile recovers gzipped data in a file and puts it into a new file.
-func (m *manager) recoverFile(oldName string, newFile *os.File) error {
-	log.Infof("recover file: %s", oldName)
+// recoveryStats tracks data discarded during recovery
+type recoveryStats struct {
+	discardedBytes   int64
+	discardedRecords int
+}
+
+// recoverFile recovers compressed data in a file and puts it into a new file
+// of the same compression, written with the current schema version. Records
+// are unchanged between version 0 and the current version. The data is read
+// line by line and only complete lines that decode as a Record are kept,
+// see isRecordLine.
+func (m *manager) recoverFile(oldName string, newFile *os.File) (recoveryStats, error) {
+	var stats recoveryStats
+	m.logger.Infof("recover file: %s", oldName)
 	in, err := os.Open(oldName)
 	if err != nil {
-		return fmt.Errorf("open %s: %s", oldName, err)
+		return stats, fmt.Errorf("open %s: %s", oldName, err)
+	}
+	defer in.Close()
+	rr, err := newRecordReader(in)
+	if err != nil {
+		return stats, fmt.Errorf("newRecordReader(%s): %s", oldName, err)
 	}
-	br := bufio.NewReader(in)
-	gzr, err := gzip.NewReader(br)
+	defer rr.Close()
+
+	w, err := newRecordWriter(newFile, rr.compression)
 	if err != nil {
-		return fmt.Errorf("gzip.NewReader(%s): %s", oldName, err)
+		return stats, fmt.Errorf("newRecordWriter(%s): %s", oldName, err)
 	}
-	defer gzr.Close()
 
-	// buffer size is arbitrary and doesn't really matter
-	b := make([]byte, 1000)
-	gzw := gzip.NewWriter(newFile)
+	br := bufio.NewReader(rr)
 	for {
-		var nRead int
-		if nRead, err = gzr.Read(b); err != nil {
-			if err != io.EOF && err.Error() != "unexpected EOF" && err.Error() != "gzip: invalid header" {
-				return fmt.Errorf("scan gzip %s: %s", oldName, err)
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF && !isTruncated(err) {
+			return stats, fmt.Errorf("scan %s %s: %s", rr.compression, oldName, err)
+		}
+		// a line without newline is incomplete
+		if err == nil && isRecordLine(line) {
+			if _, err := w.Write(line); err != nil {
+				return stats, fmt.Errorf("write %s: %s", newFile.Name(), err)
 			}
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			stats.discardedBytes += int64(len(line))
+			stats.discardedRecords++
 		}
-		_, _ = gzw.Write(b[:nRead])
 		if err != nil {
 			break
 		}
 	}
-	if err := gzw.Close(); err != nil {
-		return fmt.Errorf("close gzw %s: %s", oldName, err)
+	if err := w.Close(); err != nil {
+		return stats, fmt.Errorf("close writer %s: %s", oldName, err)
 	}
 	if err := newFile.Close(); err != nil {
-		return fmt.Errorf("close gzw file %s: %s", oldName, err)
+		return stats, fmt.Errorf("close file %s: %s", oldName, err)
+	}
+
+	if stats.discardedRecords > 0 {
+		m.logger.Warnf("%s recovered to: %s, discarded %d bytes (%d records)",
+			oldName, newFile.Name(), stats.discardedBytes, stats.discardedRecords)
+	} else {
+		m.logger.Infof("%s recovered to: %s", oldName, newFile.Name())
 	}
+	return stats, nil
+}
+
+// isRecordLine returns true if line is a JSON encoded Record with the fields
+// every record written to a bucket has
+func isRecordLine(line []byte) bool {
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return false
+	}
+	return rec.Organization != "" && rec.Environment != "" && rec.ClientReceivedStartTimestamp != 0
+}
 
-	log.Infof("%s recovered to: %s", oldName, newFile.Name())
-	return nil
+// isTruncated returns true if err indicates a partially written file
+func isTruncated(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, zstd.ErrMagicMismatch) ||
+		err.Error() == "unexpected EOF"
 }
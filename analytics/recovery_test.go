@@ -25,6 +25,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
 )
 
 func TestRecoverFile(t *testing.T) {
@@ -34,8 +36,10 @@ func TestRecoverFile(t *testing.T) {
 	}
 
 	rec := Record{
-		Organization: "hi",
-		Environment:  "test",
+		Organization:                 "hi",
+		Environment:                  "test",
+		ClientReceivedStartTimestamp: 1521221450000,
+		ClientReceivedEndTimestamp:   1521221450000,
 	}
 
 	gzWriter := gzip.NewWriter(brokeFile)
@@ -58,12 +62,12 @@ func TestRecoverFile(t *testing.T) {
 	}
 
 	// repair
-	m := manager{}
+	m := manager{logger: log.Structured(nil)}
 	fixedFile, err := os.CreateTemp("", "")
 	if err != nil {
 		t.Fatalf("os.CreateTemp(): %v", err)
 	}
-	if err := m.recoverFile(brokeFile.Name(), fixedFile); err != nil {
+	if _, err := m.recoverFile(brokeFile.Name(), fixedFile); err != nil {
 		t.Fatalf("error recovering file: %v", err)
 	}
 
@@ -223,3 +227,192 @@ func TestCrashRecovery(t *testing.T) {
 		t.Errorf("Got %d records sent, want 3: %v", len(uploaded), uploaded)
 	}
 }
+
+func TestRecoverZstdFile(t *testing.T) {
+	brokeFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatalf("os.CreateTemp(): %v", err)
+	}
+	defer os.Remove(brokeFile.Name())
+
+	rec := Record{
+		Organization:                 "hi",
+		Environment:                  "test",
+		ClientReceivedStartTimestamp: 1521221450000,
+		ClientReceivedEndTimestamp:   1521221450000,
+	}
+
+	w, err := newRecordWriter(brokeFile, Zstd)
+	if err != nil {
+		t.Fatalf("newRecordWriter: %v", err)
+	}
+	if err := json.NewEncoder(w).Encode(&rec); err != nil {
+		t.Fatalf("NewEncoder: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("w.Close(): %v", err)
+	}
+	if _, err := brokeFile.WriteString("this is not a json record"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if err := brokeFile.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+
+	m := manager{logger: log.Structured(nil)}
+	fixedFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatalf("os.CreateTemp(): %v", err)
+	}
+	defer os.Remove(fixedFile.Name())
+	if _, err := m.recoverFile(brokeFile.Name(), fixedFile); err != nil {
+		t.Fatalf("error recovering file: %v", err)
+	}
+
+	f, err := os.Open(fixedFile.Name())
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	defer f.Close()
+	rr, err := newRecordReader(f)
+	if err != nil {
+		t.Fatalf("newRecordReader: %v", err)
+	}
+	defer rr.Close()
+	if rr.compression != Zstd {
+		t.Errorf("want zstd, got %s", rr.compression)
+	}
+	recs, err := ReadRecords(rr, false)
+	if err != nil {
+		t.Fatalf("ReadRecords %s: %s", fixedFile.Name(), err)
+	}
+	if len(recs) != 1 || !reflect.DeepEqual(recs[0], rec) {
+		t.Errorf("want %v, got %v", rec, recs)
+	}
+}
+
+func TestRecoverFileDiscardsPartialRecords(t *testing.T) {
+	brokeFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatalf("os.CreateTemp(): %v", err)
+	}
+	defer os.Remove(brokeFile.Name())
+
+	rec := Record{
+		Organization:                 "hi",
+		Environment:                  "test",
+		ClientReceivedStartTimestamp: 1521221450000,
+		ClientReceivedEndTimestamp:   1521221450000,
+	}
+	invalid := "not a record\n{}\nnull\n{\"foo\":1}\n{\"organization\":\"hi\",\"environment\":\"test\"}\n"
+	partial := `{"organization":"hi","environ`
+
+	// simulate a crash: flush but never close the gzip stream
+	gzWriter := gzip.NewWriter(brokeFile)
+	if err := json.NewEncoder(gzWriter).Encode(&rec); err != nil {
+		t.Fatalf("NewEncoder: %v", err)
+	}
+	_, _ = gzWriter.Write([]byte(invalid))
+	_, _ = gzWriter.Write([]byte(partial))
+	if err := gzWriter.Flush(); err != nil {
+		t.Fatalf("gz.Flush(): %v", err)
+	}
+	if err := brokeFile.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+
+	m := manager{logger: log.Structured(nil)}
+	fixedFile, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatalf("os.CreateTemp(): %v", err)
+	}
+	defer os.Remove(fixedFile.Name())
+	stats, err := m.recoverFile(brokeFile.Name(), fixedFile)
+	if err != nil {
+		t.Fatalf("error recovering file: %v", err)
+	}
+	if stats.discardedRecords != 6 {
+		t.Errorf("want 6 discarded records, got %d", stats.discardedRecords)
+	}
+	if want := int64(len(invalid) + len(partial)); stats.discardedBytes != want {
+		t.Errorf("want %d discarded bytes, got %d", want, stats.discardedBytes)
+	}
+
+	recs, err := readRecordsFromGZipFile(fixedFile.Name())
+	if err != nil {
+		t.Fatalf("ReadRecords %s: %s", fixedFile.Name(), err)
+	}
+	if len(recs) != 1 || !reflect.DeepEqual(recs[0], rec) {
+		t.Errorf("want %v, got %v", rec, recs)
+	}
+}
+
+func TestCrashRecoveryStagedFilesKeepTenant(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	d, err := os.MkdirTemp("", "TestCrashRecoveryStagedFilesKeepTenant")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp(): %s", err)
+	}
+	defer os.RemoveAll(d)
+	baseURL, _ := url.Parse(fs.URL())
+	now := time.Now
+
+	uploader := &saasUploader{
+		client:  http.DefaultClient,
+		baseURL: baseURL,
+		now:     now,
+	}
+
+	m, err := newManager(uploader, Options{
+		BufferPath:         d,
+		StagingFileLimit:   10,
+		now:                now,
+		CollectionInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("newManager: %s", err)
+	}
+
+	ts := int64(1521221450) // This timestamp is roughly 11:30 MST on Mar. 16, 2018.
+	tenants := []string{"hi~test", "bye~prod"}
+	for _, tenant := range tenants {
+		if err := m.prepTenant(tenant); err != nil {
+			t.Fatalf("prepTenant: %v", err)
+		}
+		org, env, _ := getOrgAndEnvFromTenant(tenant)
+		rec := Record{
+			Organization:                 org,
+			Environment:                  env,
+			ClientReceivedStartTimestamp: ts * 1000,
+			ClientReceivedEndTimestamp:   ts * 1000,
+		}
+		f, err := os.Create(filepath.Join(m.getStagingDir(tenant), "staged.gz"))
+		if err != nil {
+			t.Fatalf("error creating staged file: %s", err)
+		}
+		gz := gzip.NewWriter(f)
+		if err := json.NewEncoder(gz).Encode(&rec); err != nil {
+			t.Fatalf("error encoding file into records: %v", err)
+		}
+		gz.Close()
+		f.Close()
+	}
+
+	m.Start()
+	time.Sleep(50 * time.Millisecond)
+	m.Close()
+
+	for _, tenant := range tenants {
+		org, env, _ := getOrgAndEnvFromTenant(tenant)
+		uploaded := fs.uploadedRecords(tenant)
+		if len(uploaded) != 1 {
+			t.Errorf("tenant %s: got %d records sent, want 1: %v", tenant, len(uploaded), uploaded)
+			continue
+		}
+		if uploaded[0].Organization != org || uploaded[0].Environment != env {
+			t.Errorf("tenant %s: got record for %s~%s", tenant, uploaded[0].Organization, uploaded[0].Environment)
+		}
+	}
+}
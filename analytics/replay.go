@@ -0,0 +1,222 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	// Client is a configured HTTPClient
+	Client *http.Client
+	// Base Apigee URL
+	BaseURL *url.URL
+	// DryRun validates files without uploading them
+	DryRun bool
+	// Delete removes files once all of their records are uploaded. Files with
+	// invalid records are kept so the records aren't lost.
+	Delete bool
+	// Progress, if set, is called after each file is processed
+	Progress func(ReplayProgress)
+	// TracerProvider, if set, is used to trace uploads to Apigee
+	TracerProvider trace.TracerProvider
+	// now is for testing
+	now func() time.Time
+}
+
+// ReplayProgress reports the result of replaying a file.
+type ReplayProgress struct {
+	// Tenant is "org~env"
+	Tenant string
+	// File is the path of the file
+	File string
+	// Records is the number of valid records in the file
+	Records int
+	// Invalid is the number of records that failed validation and were skipped
+	Invalid int
+	// Uploaded is true if the valid records were uploaded
+	Uploaded bool
+	// Err is set if the file could not be read or uploaded
+	Err error
+	// Done is the number of files processed so far
+	Done int
+	// Total is the number of files to process
+	Total int
+}
+
+// Replay uploads analytics files from dir, which must be laid out like the
+// staging directory: one "org~env" directory per tenant containing compressed
+// NDJSON files. Each record is validated and invalid records are skipped.
+// Returns an errorset of the files that failed.
+func Replay(ctx context.Context, dir string, opts ReplayOptions) error {
+	if opts.Client == nil || opts.BaseURL == nil {
+		return fmt.Errorf("client and base url are required")
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+
+	type tenantFile struct {
+		tenant, path string
+	}
+	var files []tenantFile
+	tenantDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("ReadDir(%s): %s", dir, err)
+	}
+	for _, tenantDir := range tenantDirs {
+		tenant := tenantDir.Name()
+		if !tenantDir.IsDir() {
+			continue
+		}
+		if _, _, err := getOrgAndEnvFromTenant(tenant); err != nil {
+			return fmt.Errorf("invalid tenant dir %s: %s", tenant, err)
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, tenant))
+		if err != nil {
+			return fmt.Errorf("ReadDir(%s): %s", tenant, err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, tenantFile{tenant, filepath.Join(dir, tenant, e.Name())})
+			}
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "axreplay")
+	if err != nil {
+		return fmt.Errorf("MkdirTemp: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	uploader := &saasUploader{
+		client:         opts.Client,
+		baseURL:        opts.BaseURL,
+		now:            opts.now,
+		isGCPManaged:   (&Options{BaseURL: opts.BaseURL}).isGCPManaged(),
+		tracerProvider: opts.TracerProvider,
+	}
+
+	var errs error
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return errorset.Append(errs, err)
+		}
+		p := replayFile(ctx, uploader, f.tenant, f.path, tempDir, opts)
+		p.Done = i + 1
+		p.Total = len(files)
+		if p.Err != nil {
+			errs = errorset.Append(errs, fmt.Errorf("%s: %s", f.path, p.Err))
+		}
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	return errs
+}
+
+// replayFile validates the records in file and uploads the valid ones
+func replayFile(ctx context.Context, up *saasUploader, tenant, file, tempDir string, opts ReplayOptions) ReplayProgress {
+	p := ReplayProgress{
+		Tenant: tenant,
+		File:   file,
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		p.Err = err
+		return p
+	}
+	defer in.Close()
+	rr, err := newRecordReader(in)
+	if err != nil {
+		p.Err = err
+		return p
+	}
+	defer rr.Close()
+
+	outName := filepath.Join(tempDir, filepath.Base(file))
+	out, err := os.Create(outName)
+	if err != nil {
+		p.Err = err
+		return p
+	}
+	defer os.Remove(outName)
+	w, err := newRecordWriter(out, rr.compression)
+	if err != nil {
+		out.Close()
+		p.Err = err
+		return p
+	}
+
+	now := opts.now()
+	br := bufio.NewReader(rr)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// validate the decoded record, but write the original line
+			// as Attributes are not decoded
+			var rec Record
+			if json.Unmarshal(line, &rec) != nil || rec.validate(now) != nil {
+				p.Invalid++
+			} else if _, err := w.Write(append(bytes.TrimRight(line, "\n"), '\n')); err != nil {
+				p.Err = err
+				break
+			} else {
+				p.Records++
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				p.Err = err
+			}
+			break
+		}
+	}
+	if err := w.Close(); err != nil && p.Err == nil {
+		p.Err = err
+	}
+	if err := out.Close(); err != nil && p.Err == nil {
+		p.Err = err
+	}
+	if p.Err != nil || opts.DryRun {
+		return p
+	}
+
+	if p.Records > 0 {
+		if p.Err = up.upload(ctx, tenant, outName); p.Err != nil {
+			return p
+		}
+		p.Uploaded = true
+	}
+	if opts.Delete && p.Invalid == 0 {
+		p.Err = os.Remove(file)
+	}
+	return p
+}
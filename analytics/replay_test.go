@@ -0,0 +1,137 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	ts := int64(1521221450) // This timestamp is roughly 11:30 MST on Mar. 16, 2018.
+	now := func() time.Time { return time.Unix(ts, 0) }
+
+	d, err := os.MkdirTemp("", "TestReplay")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp(): %s", err)
+	}
+	defer os.RemoveAll(d)
+
+	tenant := "hi~test"
+	if err := os.Mkdir(filepath.Join(d, tenant), 0700); err != nil {
+		t.Fatal(err)
+	}
+	good := Record{
+		Organization:                 "hi",
+		Environment:                  "test",
+		ClientReceivedStartTimestamp: ts * 1000,
+		ClientReceivedEndTimestamp:   ts * 1000,
+		GatewayFlowID:                "flow",
+		Attributes:                   []Attribute{{Name: "attr", Value: "value"}},
+	}
+	bad := good
+	bad.Organization = ""
+	file := filepath.Join(d, tenant, "staged.gz")
+	writeReplayFile(t, file, good, bad, good)
+
+	baseURL, _ := url.Parse(fs.URL())
+	var progress []ReplayProgress
+	opts := ReplayOptions{
+		Client:   http.DefaultClient,
+		BaseURL:  baseURL,
+		DryRun:   true,
+		Progress: func(p ReplayProgress) { progress = append(progress, p) },
+		now:      now,
+	}
+
+	if err := Replay(context.Background(), d, opts); err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+	if len(progress) != 1 {
+		t.Fatalf("want 1 progress, got: %v", progress)
+	}
+	p := progress[0]
+	if p.Tenant != tenant || p.File != file || p.Records != 2 || p.Invalid != 1 ||
+		p.Uploaded || p.Done != 1 || p.Total != 1 {
+		t.Errorf("unexpected dry run progress: %#v", p)
+	}
+	if len(fs.pushes()) != 0 {
+		t.Errorf("dry run should not upload, got: %v", fs.pushes())
+	}
+
+	progress = nil
+	opts.DryRun = false
+	opts.Delete = true
+	if err := Replay(context.Background(), d, opts); err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+	if len(progress) != 1 || !progress[0].Uploaded {
+		t.Errorf("want uploaded, got: %v", progress)
+	}
+	uploaded := fs.uploadedRecords(tenant)
+	if len(uploaded) != 2 {
+		t.Fatalf("want 2 records uploaded, got %d", len(uploaded))
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("want %s with invalid records kept, got: %v", file, err)
+	}
+
+	// a file with only valid records is deleted
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	writeReplayFile(t, file, good, good)
+	progress = nil
+	if err := Replay(context.Background(), d, opts); err != nil {
+		t.Fatalf("Replay(): %v", err)
+	}
+	if len(progress) != 1 || !progress[0].Uploaded || progress[0].Invalid != 0 {
+		t.Errorf("want uploaded, got: %v", progress)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("want %s deleted, got: %v", file, err)
+	}
+}
+
+func writeReplayFile(t *testing.T, file string, records ...Record) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := newRecordWriter(f, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
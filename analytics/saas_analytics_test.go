@@ -17,7 +17,7 @@ package analytics
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -91,9 +91,9 @@ func (fs *fakeServer) handler(t *testing.T) http.Handler {
 			w.WriteHeader(fs.failUpload)
 			return
 		}
-		gz, err := gzip.NewReader(r.Body)
+		gz, err := newRecordReader(r.Body)
 		if err != nil {
-			t.Fatalf("Error on gzip.NewReader: %s", err)
+			t.Fatalf("Error on newRecordReader: %s", err)
 		}
 		defer gz.Close()
 		defer r.Body.Close()
@@ -176,6 +176,68 @@ func (fs *fakeServer) uploadedRecords(tenant string) []Record {
 	return recs
 }
 
+// testTenant is the tenant of a testManager's records
+const testTenant = "hi~test"
+
+// A testManager is a manager that uploads to a fakeServer, with a record and
+// an authContext for testTenant.
+type testManager struct {
+	*manager
+	fs          *fakeServer
+	records     []Record
+	authContext *auth.Context
+}
+
+// newTestManager creates, but does not start, a manager with opts that
+// uploads to a new fakeServer. BufferPath and now are set, CollectionInterval
+// and StagingFileLimit are defaulted. The fakeServer is closed on cleanup.
+func newTestManager(t *testing.T, opts Options) *testManager {
+	fs := newFakeServer(t)
+	t.Cleanup(fs.close)
+
+	ts := int64(1521221450) // This timestamp is roughly 11:30 MST on Mar. 16, 2018.
+	now := func() time.Time { return time.Unix(ts, 0) }
+
+	baseURL, _ := url.Parse(fs.URL())
+	uploader := &saasUploader{
+		client:  http.DefaultClient,
+		baseURL: baseURL,
+		now:     now,
+	}
+
+	opts.BufferPath = t.TempDir()
+	opts.now = now
+	if opts.CollectionInterval == 0 {
+		opts.CollectionInterval = time.Minute
+	}
+	if opts.StagingFileLimit == 0 {
+		opts.StagingFileLimit = 10
+	}
+	m, err := newManager(uploader, opts)
+	if err != nil {
+		t.Fatalf("newManager: %s", err)
+	}
+
+	tc := authtest.NewContext(fs.URL())
+	tc.SetOrganization("hi")
+	tc.SetEnvironment("test")
+
+	return &testManager{
+		manager: m,
+		fs:      fs,
+		records: []Record{
+			{
+				Organization:                 "hi",
+				Environment:                  "test",
+				ClientReceivedStartTimestamp: ts * 1000,
+				ClientReceivedEndTimestamp:   ts * 1000,
+				APIProxy:                     "proxy",
+			},
+		},
+		authContext: &auth.Context{Context: tc},
+	}
+}
+
 func TestPushAnalytics(t *testing.T) {
 	fs := newFakeServer(t)
 	defer fs.close()
@@ -741,13 +803,16 @@ func TestGCPSignedURLRequest(t *testing.T) {
 		isGCPManaged: true,
 	}
 
-	req, err := uploader.gcpGetSignedURLHTTPRequest("hi~test", "record_file")
+	req, err := uploader.gcpGetSignedURLHTTPRequest("hi~test", "record_file", Zstd)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if req.URL.Host != "apigee.googleapis.com" {
 		t.Errorf("wrong host: want %s got %s", "apigee.googleapis.com", req.URL.Host)
 	}
+	if fp := req.URL.Query().Get("relative_file_path"); !strings.HasSuffix(fp, ".zst") {
+		t.Errorf("want .zst relative_file_path, got %s", fp)
+	}
 }
 
 func TestLegacySignedURLRequest(t *testing.T) {
@@ -760,11 +825,49 @@ func TestLegacySignedURLRequest(t *testing.T) {
 		now:     time.Now,
 	}
 
-	req, err := uploader.legacyGetSignedURLHTTPRequest("hi~test", "record_file")
+	req, err := uploader.legacyGetSignedURLHTTPRequest("hi~test", "record_file", Zstd)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if req.URL.Host != legacyHost {
 		t.Errorf("wrong host: want %s got %s", legacyHost, req.URL.Host)
 	}
+	if ct := req.URL.Query().Get("file_content_type"); ct != "application/zstd" {
+		t.Errorf("want file_content_type application/zstd, got %s", ct)
+	}
+}
+
+func TestSignedURLRequestFileCompression(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	baseURL, _ := url.Parse(fs.URL())
+
+	// configured for zstd, but the file was staged with gzip
+	uploader := &saasUploader{
+		client:   http.DefaultClient,
+		baseURL:  baseURL,
+		now:      time.Now,
+		compress: Zstd,
+	}
+	fileName := filepath.Join(t.TempDir(), "staged.gz")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := newRecordWriter(f, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := uploader.signedURLRequest(context.Background(), "hi~test", fileName, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != Gzip.contentType() {
+		t.Errorf("want Content-Type %s, got %s", Gzip.contentType(), ct)
+	}
 }
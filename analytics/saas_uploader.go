@@ -17,6 +17,7 @@ package analytics
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -30,23 +31,32 @@ import (
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// errFileMissing is returned when a staged file was removed before its upload,
+// usually because it was dropped to make room in the buffer.
+var errFileMissing = errors.New("staged file no longer exists")
+
 type uploader interface {
 	workFunc(tenant, fileName string) util.WorkFunc
 	write(records []Record, writer io.Writer) error
-	isGzipped() bool
+	stream(ctx context.Context, tenant, fileName string, body io.Reader) error
+	compression() Compression
 }
 
 type saasUploader struct {
-	client       *http.Client
-	baseURL      *url.URL
-	now          func() time.Time
-	isGCPManaged bool
+	client         *http.Client
+	baseURL        *url.URL
+	now            func() time.Time
+	isGCPManaged   bool
+	compress       Compression
+	tracerProvider trace.TracerProvider
+	logger         log.StructuredLogger // global log.Log if nil
 }
 
-func (s *saasUploader) isGzipped() bool {
-	return true
+func (s *saasUploader) compression() Compression {
+	return s.compress
 }
 
 // format and write records
@@ -63,33 +73,40 @@ func (s *saasUploader) write(records []Record, writer io.Writer) error {
 func (s *saasUploader) workFunc(tenant, fileName string) util.WorkFunc {
 	return func(ctx context.Context) error {
 		if ctx.Err() == nil {
-			return s.upload(tenant, fileName)
+			return s.upload(ctx, tenant, fileName)
 		}
 
-		log.Warnf("canceled upload of %s: %v", fileName, ctx.Err())
+		s.logFor(tenant, fileName).Warnf("canceled upload of %s: %v", fileName, ctx.Err())
 		err := os.Remove(fileName)
 		if err != nil && !os.IsNotExist(err) {
-			log.Warnf("unable to remove file %s: %v", fileName, err)
+			s.logFor(tenant, fileName).Warnf("unable to remove file %s: %v", fileName, err)
 		}
 		return nil
 	}
 }
 
 // upload sends a file to SaaS UAP
-func (s *saasUploader) upload(tenant, fileName string) error {
+func (s *saasUploader) upload(ctx context.Context, tenant, fileName string) (err error) {
+	ctx, span := s.startSpan(ctx, "apigee.analytics.upload", tenant)
+	defer func() { util.EndSpan(span, err) }()
 
 	file, err := os.Open(fileName)
 	if err != nil {
+		if os.IsNotExist(err) { // dropped, nothing to do
+			s.logFor(tenant, fileName).Warnf("staged file %s no longer exists, skipping upload", fileName)
+			return errFileMissing
+		}
 		return err
 	}
 
-	log.Debugf("getting signed URL for %s", fileName)
-	req, err := s.signedURLRequest(tenant, fileName, file)
+	s.logFor(tenant, fileName).Debugf("getting signed URL for %s", fileName)
+	req, err := s.signedURLRequest(ctx, tenant, fileName, file)
 	if err != nil {
+		file.Close()
 		return fmt.Errorf("signedURLRequest: %v", err)
 	}
 
-	log.Debugf("uploading %s to %s", fileName, req.URL.String())
+	s.logFor(tenant, fileName).Debugf("uploading %s to %s", fileName, req.URL.String())
 	resp, err := s.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("client.Do(): %s", err)
@@ -107,6 +124,53 @@ func (s *saasUploader) upload(tenant, fileName string) error {
 	return nil
 }
 
+// stream sends body to SaaS UAP as it is written using a chunked upload.
+// The upload is canceled with ctx.
+func (s *saasUploader) stream(ctx context.Context, tenant, fileName string, body io.Reader) (err error) {
+	ctx, span := s.startSpan(ctx, "apigee.analytics.stream", tenant)
+	defer func() { util.EndSpan(span, err) }()
+
+	s.logFor(tenant, fileName).Debugf("getting signed URL for stream %s", fileName)
+	signedURL, err := s.signedURL(ctx, tenant, fileName, s.compress)
+	if err != nil {
+		return fmt.Errorf("signedURL: %s", err)
+	}
+	req, err := s.uploadRequest(ctx, signedURL, body, s.compress)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = -1 // chunked
+
+	s.logFor(tenant, fileName).Debugf("streaming %s to %s", fileName, req.URL.String())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("client.Do(): %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body) // get the response for debug purpose
+		return fmt.Errorf("stream %s returned %s %s", fileName, resp.Status, string(data))
+	}
+	return nil
+}
+
+// logFor returns the logger with fields for tenant and fileName
+func (s *saasUploader) logFor(tenant, fileName string) log.StructuredLogger {
+	logger := s.logger
+	if logger == nil {
+		logger = log.Named("analytics")
+	}
+	return logger.WithFields(log.Fields{"tenant": tenant, "file": fileName})
+}
+
+// startSpan starts a client span for tenant
+func (s *saasUploader) startSpan(ctx context.Context, name, tenant string) (context.Context, trace.Span) {
+	org, env := s.orgEnvFromSubdir(tenant)
+	return util.Tracer(s.tracerProvider, "analytics").Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(util.OrgEnv(org, env)...))
+}
+
 func (s *saasUploader) orgEnvFromSubdir(subdir string) (string, string) {
 	splits := strings.Split(subdir, "~")
 	if len(splits) == 2 {
@@ -123,44 +187,63 @@ func (s *saasUploader) uploadDir() string {
 	return fmt.Sprintf(pathFmt, d, t)
 }
 
-func (s *saasUploader) signedURLRequest(subdir, filename string, file *os.File) (*http.Request, error) {
+// signedURLRequest returns a PUT of file to a signed URL. The content type is
+// from the file's compression as it may not be the configured compression,
+// such as for files staged before the configuration changed.
+func (s *saasUploader) signedURLRequest(ctx context.Context, subdir, filename string, file *os.File) (*http.Request, error) {
 	fi, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
+	c, ok := fileCompression(file)
+	if !ok {
+		c = s.compress
+	}
 
-	signedURL, err := s.signedURL(subdir, filename)
+	signedURL, err := s.signedURL(ctx, subdir, filename, c)
 	if err != nil {
 		return nil, fmt.Errorf("signedURL: %s", err)
 	}
-	req, err := http.NewRequest("PUT", signedURL, file)
+	req, err := s.uploadRequest(ctx, signedURL, file, c)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = fi.Size()
+
+	return req, nil
+}
+
+// uploadRequest returns a PUT of body, compressed with c, to signedURL
+func (s *saasUploader) uploadRequest(ctx context.Context, signedURL string, body io.Reader, c Compression) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", signedURL, body)
 	if err != nil {
 		return nil, fmt.Errorf("http.NewRequest: %s", err)
 	}
+	util.InjectTraceContext(ctx, req)
 
 	if !s.isGCPManaged {
 		// additional headers for legacy saas
 		req.Header.Set("Expect", "100-continue")
-		req.Header.Set("Content-Type", "application/x-gzip")
+		req.Header.Set("Content-Type", c.contentType())
 		req.Header.Set("x-amz-server-side-encryption", "AES256")
 	}
-	req.ContentLength = fi.Size()
-
 	return req, nil
 }
 
-// signedURL asks for a signed URL that can be used to upload gzip file
-func (s *saasUploader) signedURL(subdir, fileName string) (string, error) {
+// signedURL asks for a signed URL that can be used to upload a file compressed with c
+func (s *saasUploader) signedURL(ctx context.Context, subdir, fileName string, c Compression) (string, error) {
 	var req *http.Request
 	var err error
 	if s.isGCPManaged {
-		req, err = s.gcpGetSignedURLHTTPRequest(subdir, fileName)
+		req, err = s.gcpGetSignedURLHTTPRequest(subdir, fileName, c)
 	} else {
-		req, err = s.legacyGetSignedURLHTTPRequest(subdir, fileName)
+		req, err = s.legacyGetSignedURLHTTPRequest(subdir, fileName, c)
 	}
 	if err != nil {
 		return "", err
 	}
+	req = req.WithContext(ctx)
+	util.InjectTraceContext(ctx, req)
 
 	resp, err := s.client.Do(req)
 	if err != nil {
@@ -182,7 +265,7 @@ func (s *saasUploader) signedURL(subdir, fileName string) (string, error) {
 }
 
 // legacyGetSignedURLHTTPRequest returns a *http.Request based on the the legacy analytics path and parameters
-func (s *saasUploader) legacyGetSignedURLHTTPRequest(subdir, fileName string) (*http.Request, error) {
+func (s *saasUploader) legacyGetSignedURLHTTPRequest(subdir, fileName string, c Compression) (*http.Request, error) {
 	org, env := s.orgEnvFromSubdir(subdir)
 	if org == "" || env == "" {
 		return nil, fmt.Errorf("invalid subdir %s", subdir)
@@ -200,7 +283,7 @@ func (s *saasUploader) legacyGetSignedURLHTTPRequest(subdir, fileName string) (*
 	q := req.URL.Query()
 	q.Add("tenant", subdir)
 	q.Add("relative_file_path", relPath)
-	q.Add("file_content_type", "application/x-gzip")
+	q.Add("file_content_type", c.contentType())
 	q.Add("encrypt", "true")
 	req.URL.RawQuery = q.Encode()
 
@@ -208,7 +291,7 @@ func (s *saasUploader) legacyGetSignedURLHTTPRequest(subdir, fileName string) (*
 }
 
 // gcpGetSignedURLHTTPRequest returns a *http.Request based on the UAP analytics path and parameters
-func (s *saasUploader) gcpGetSignedURLHTTPRequest(subdir, fileName string) (*http.Request, error) {
+func (s *saasUploader) gcpGetSignedURLHTTPRequest(subdir, fileName string, c Compression) (*http.Request, error) {
 	org, env := s.orgEnvFromSubdir(subdir)
 	if org == "" || env == "" {
 		return nil, fmt.Errorf("invalid subdir %s", subdir)
@@ -221,7 +304,7 @@ func (s *saasUploader) gcpGetSignedURLHTTPRequest(subdir, fileName string) (*htt
 		return nil, err
 	}
 
-	relPath := fmt.Sprintf(relativeFilePathFmt, time.Now().Unix(), org, env, uuid.New().String())
+	relPath := fmt.Sprintf(relativeFilePathFmt, time.Now().Unix(), org, env, uuid.New().String(), c.extension())
 
 	q := req.URL.Query()
 	q.Add("repo", repoName)
@@ -0,0 +1,179 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+// AttributeType is the type of value an Attribute holds.
+type AttributeType int
+
+const (
+	// AnyAttribute accepts any valid Attribute value.
+	AnyAttribute AttributeType = iota
+	// StringAttribute accepts string values.
+	StringAttribute
+	// NumberAttribute accepts integer and floating point values.
+	NumberAttribute
+	// BoolAttribute accepts boolean values.
+	BoolAttribute
+	// TimeAttribute accepts time.Time values.
+	TimeAttribute
+)
+
+func (t AttributeType) String() string {
+	switch t {
+	case AnyAttribute:
+		return "any"
+	case StringAttribute:
+		return "string"
+	case NumberAttribute:
+		return "number"
+	case BoolAttribute:
+		return "bool"
+	case TimeAttribute:
+		return "time"
+	default:
+		return fmt.Sprintf("AttributeType(%d)", int(t))
+	}
+}
+
+// matches returns true if val is of type t
+func (t AttributeType) matches(val interface{}) bool {
+	if _, ok := val.(time.Time); ok {
+		return t == AnyAttribute || t == TimeAttribute
+	}
+	switch reflect.TypeOf(val).Kind() {
+	case reflect.String:
+		return t == AnyAttribute || t == StringAttribute
+	case reflect.Bool:
+		return t == AnyAttribute || t == BoolAttribute
+	case
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return t == AnyAttribute || t == NumberAttribute
+	default:
+		return false
+	}
+}
+
+// An AttributeDef declares an Attribute that a Record may include.
+type AttributeDef struct {
+	// Name of the Attribute, the "dc." prefix is optional
+	Name string
+	// Type of the Attribute value
+	Type AttributeType
+	// MaxLength is the maximum bytes of a string value.
+	// Zero means the default limit of 400 bytes.
+	MaxLength int
+	// Required Attributes must be present in every Record
+	Required bool
+}
+
+// A RecordError reports why a Record passed to SendRecords was rejected.
+type RecordError struct {
+	// Index of the Record in the slice passed to SendRecords
+	Index int
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.Index, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// attributeSchema is the compiled form of Options.AttributeSchema
+type attributeSchema struct {
+	defs     map[string]AttributeDef // name without prefix -> def
+	required []string
+}
+
+// newAttributeSchema returns nil if defs is empty
+func newAttributeSchema(defs []AttributeDef) (*attributeSchema, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+	if len(defs) > maxNumAttributes {
+		return nil, fmt.Errorf("attribute schema is limited to %d attributes", maxNumAttributes)
+	}
+	s := &attributeSchema{
+		defs: make(map[string]AttributeDef, len(defs)),
+	}
+	for _, def := range defs {
+		name := strings.TrimPrefix(def.Name, attributePrefix)
+		if name == "" {
+			return nil, fmt.Errorf("attribute schema name is required")
+		}
+		if _, ok := s.defs[name]; ok {
+			return nil, fmt.Errorf("attribute schema has duplicate name: %s", name)
+		}
+		if def.Type < AnyAttribute || def.Type > TimeAttribute {
+			return nil, fmt.Errorf("attribute %s has invalid type: %s", name, def.Type)
+		}
+		if def.MaxLength < 0 || def.MaxLength > maxAttributeValueBytes {
+			return nil, fmt.Errorf("attribute %s max length must be between 0 and %d", name, maxAttributeValueBytes)
+		}
+		if def.MaxLength == 0 {
+			def.MaxLength = maxAttributeValueBytes
+		}
+		s.defs[name] = def
+		if def.Required {
+			s.required = append(s.required, name)
+		}
+	}
+	return s, nil
+}
+
+// validate checks a Record's Attributes against the schema
+func (s *attributeSchema) validate(attrs []Attribute) error {
+	var err error
+	seen := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		name := strings.TrimPrefix(attr.Name, attributePrefix)
+		def, ok := s.defs[name]
+		if !ok {
+			err = errorset.Append(err, fmt.Errorf("attribute %s is not declared", name))
+			continue
+		}
+		if seen[name] {
+			err = errorset.Append(err, fmt.Errorf("attribute %s is duplicated", name))
+			continue
+		}
+		seen[name] = true
+		if attr.Value == nil || !def.Type.matches(attr.Value) {
+			err = errorset.Append(err, fmt.Errorf("attribute %s must be type %s, got: %T", name, def.Type, attr.Value))
+			continue
+		}
+		if str, ok := attr.Value.(string); ok && len(str) > def.MaxLength {
+			err = errorset.Append(err, fmt.Errorf("attribute %s exceeds max length of %d bytes", name, def.MaxLength))
+		}
+	}
+	for _, name := range s.required {
+		if !seen[name] {
+			err = errorset.Append(err, fmt.Errorf("attribute %s is required", name))
+		}
+	}
+	return err
+}
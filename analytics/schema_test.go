@@ -0,0 +1,177 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
+)
+
+func TestAttributeSchemaOptions(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		defs    []AttributeDef
+		wantErr string
+	}{
+		{"empty", nil, ""},
+		{"good", []AttributeDef{{Name: "a"}, {Name: "dc.b", Type: StringAttribute, MaxLength: 10}}, ""},
+		{"missing name", []AttributeDef{{Name: "dc."}}, "name is required"},
+		{"duplicate", []AttributeDef{{Name: "a"}, {Name: "dc.a"}}, "duplicate name: a"},
+		{"bad type", []AttributeDef{{Name: "a", Type: 99}}, "invalid type"},
+		{"bad length", []AttributeDef{{Name: "a", MaxLength: 401}}, "max length"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := newAttributeSchema(test.defs)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("want error %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAttributeSchemaValidate(t *testing.T) {
+	schema, err := newAttributeSchema([]AttributeDef{
+		{Name: "str", Type: StringAttribute, MaxLength: 5, Required: true},
+		{Name: "num", Type: NumberAttribute},
+		{Name: "bool", Type: BoolAttribute},
+		{Name: "time", Type: TimeAttribute},
+		{Name: "any"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		attrs   []Attribute
+		wantErr string
+	}{
+		{"good", []Attribute{
+			{Name: "dc.str", Value: "hello"},
+			{Name: "num", Value: 1.5},
+			{Name: "bool", Value: true},
+			{Name: "time", Value: time.Now()},
+			{Name: "any", Value: uint8(1)},
+		}, ""},
+		{"missing required", []Attribute{{Name: "num", Value: 1}}, "str is required"},
+		{"too long", []Attribute{{Name: "str", Value: "hello!"}}, "exceeds max length of 5"},
+		{"wrong type", []Attribute{{Name: "str", Value: "a"}, {Name: "num", Value: "1"}}, "num must be type number"},
+		{"nil value", []Attribute{{Name: "str", Value: "a"}, {Name: "any", Value: nil}}, "any must be type any"},
+		{"undeclared", []Attribute{{Name: "str", Value: "a"}, {Name: "other", Value: 1}}, "other is not declared"},
+		{"duplicate", []Attribute{{Name: "str", Value: "a"}, {Name: "dc.str", Value: "b"}}, "str is duplicated"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := schema.validate(test.attrs)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("want no error, got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("want error %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSendRecordsWithSchema(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+
+	ts := int64(1521221450) // This timestamp is roughly 11:30 MST on Mar. 16, 2018.
+	now := func() time.Time { return time.Unix(ts, 0) }
+
+	workDir, err := os.MkdirTemp("", "TestSendRecordsWithSchema")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp(): %s", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	baseURL, _ := url.Parse(fs.URL())
+
+	uploader := &saasUploader{
+		client:  http.DefaultClient,
+		baseURL: baseURL,
+		now:     now,
+	}
+
+	m, err := newManager(uploader, Options{
+		BufferPath:         workDir,
+		StagingFileLimit:   10,
+		now:                now,
+		CollectionInterval: time.Minute,
+		AttributeSchema: []AttributeDef{
+			{Name: "plan", Type: StringAttribute, Required: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newManager: %s", err)
+	}
+	m.Start()
+	defer m.Close()
+
+	record := Record{
+		Organization:                 "hi",
+		Environment:                  "test",
+		ClientReceivedStartTimestamp: ts * 1000,
+		ClientReceivedEndTimestamp:   ts * 1000,
+	}
+	good := record
+	good.Attributes = []Attribute{{Name: "plan", Value: "gold"}}
+	badType := record
+	badType.Attributes = []Attribute{{Name: "plan", Value: 1}}
+
+	tc := authtest.NewContext(fs.URL())
+	tc.SetOrganization("hi")
+	tc.SetEnvironment("test")
+	authContext := &auth.Context{Context: tc}
+
+	err = m.SendRecords(authContext, []Record{good, record, badType})
+	errs := errorset.Errors(err)
+	if len(errs) != 2 {
+		t.Fatalf("want 2 errors, got: %v", err)
+	}
+	for i, wantIndex := range []int{1, 2} {
+		var recErr *RecordError
+		if !errors.As(errs[i], &recErr) {
+			t.Fatalf("want RecordError, got: %#v", errs[i])
+		}
+		if recErr.Index != wantIndex {
+			t.Errorf("want index %d, got %d", wantIndex, recErr.Index)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Flush(ctx); err != nil {
+		t.Fatalf("Flush(): %v", err)
+	}
+	if got := fs.uploadedRecords("hi~test"); len(got) != 1 {
+		t.Errorf("want 1 record uploaded, got %d", len(got))
+	}
+}
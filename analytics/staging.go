@@ -21,7 +21,6 @@ import (
 	"sync"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/errorset"
-	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -30,15 +29,15 @@ func (m *manager) stageFile(tenant, tempFile string, numRecs int) {
 	stageDir := m.getStagingDir(tenant)
 	stagedFile := filepath.Join(stageDir, filepath.Base(tempFile))
 	if err := os.Rename(tempFile, stagedFile); err != nil {
-		log.Errorf("can't rename file: %s", err)
+		m.fileLogger(tenant, tempFile).Errorf("can't rename file: %s", err)
 		return
 	}
 	org, env, _ := getOrgAndEnvFromTenant(tenant)
 	promLabels := prometheus.Labels{"org": org, "env": env, "file": stagedFile}
-	prometheusRecordsByFile.With(promLabels).Set(float64(numRecs))
+	m.metrics.recordsByFile.With(promLabels).Set(float64(numRecs))
 
 	m.upload(tenant, stagedFile, numRecs)
-	log.Debugf("staged file: %s", stagedFile)
+	m.fileLogger(tenant, stagedFile).Debugf("staged file: %s", stagedFile)
 }
 
 func (m *manager) getFilesInStaging() ([]string, error) {
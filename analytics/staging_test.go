@@ -15,6 +15,7 @@
 package analytics
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"os"
@@ -113,3 +114,104 @@ func filesIn(path string) []string {
 	}
 	return result
 }
+
+func TestBufferSizeLimit(t *testing.T) {
+	for _, test := range []struct {
+		desc       string
+		policy     OverflowPolicy
+		wantErr    error
+		wantStaged int
+	}{
+		{"reject new", RejectNew, ErrBufferFull, 1},
+		{"drop oldest", DropOldest, nil, 1},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			tm := newTestManager(t, Options{
+				BufferSizeLimit: 1,
+				OverflowPolicy:  test.policy,
+			})
+			tm.fs.failUpload = http.StatusInternalServerError
+			tm.bufferCheckInterval = 0
+			tm.Start()
+			defer tm.Close()
+
+			if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+				t.Fatalf("SendRecords(): %s", err)
+			}
+			tm.stageAllBucketsWait()
+
+			for i := 0; i < 3; i++ {
+				if err := tm.SendRecords(tm.authContext, tm.records); err != test.wantErr {
+					t.Errorf("want: %v, got: %v", test.wantErr, err)
+				}
+				tm.stageAllBucketsWait()
+			}
+
+			if f := filesIn(tm.getStagingDir(testTenant)); len(f) != test.wantStaged {
+				t.Errorf("got %d files, want %d: %v", len(f), test.wantStaged, f)
+			}
+		})
+	}
+}
+
+func TestBufferSizeLimitBlock(t *testing.T) {
+	tm := newTestManager(t, Options{
+		BufferSizeLimit: 1,
+		OverflowPolicy:  Block,
+	})
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.bufferCheckInterval = 0
+	tm.Start()
+	defer tm.Close()
+
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	tm.stageAllBucketsWait()
+
+	// blocks until the buffer has room
+	done := make(chan error, 1)
+	go func() {
+		done <- tm.SendRecords(tm.authContext, tm.records)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("SendRecords() should block, got: %v", err)
+	case <-time.After(3 * bufferBlockPollInterval):
+	}
+	for _, f := range filesIn(tm.getStagingDir(testTenant)) {
+		if err := os.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("SendRecords(): %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendRecords() should unblock when the buffer has room")
+	}
+}
+
+func TestBufferSizeLimitBlockCanceled(t *testing.T) {
+	tm := newTestManager(t, Options{
+		BufferSizeLimit: 1,
+		OverflowPolicy:  Block,
+	})
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.bufferCheckInterval = 0
+	tm.Start()
+	defer tm.Close()
+
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	tm.stageAllBucketsWait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*bufferBlockPollInterval)
+	defer cancel()
+	if err := tm.SendRecordsWithContext(ctx, tm.authContext, tm.records); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	streamBufferSize    = 64          // writes buffered while the stream catches up
+	streamFinishTimeout = time.Minute // for the stream to complete once the bucket is closed
+)
+
+// errStreamBehind abandons a stream that can't keep up with bucket writes
+var errStreamBehind = errors.New("streaming upload fell behind")
+
+// A streamWriter tees compressed records into a bucket file and a streaming
+// upload. The file is kept so the records can be staged if the stream fails.
+// Writes to the stream are buffered so a slow upload doesn't block the
+// bucket. If the buffer fills, the stream is abandoned.
+type streamWriter struct {
+	file   io.Writer
+	chunks chan []byte
+	err    error // first stream error, stops writes to chunks
+	cancel context.CancelFunc
+	result chan error
+}
+
+func newStreamWriter(up uploader, tenant string, file *os.File) *streamWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	s := &streamWriter{
+		file:   file,
+		chunks: make(chan []byte, streamBufferSize),
+		cancel: cancel,
+		result: make(chan error, 1),
+	}
+	go func() {
+		for chunk := range s.chunks {
+			if _, err := pw.Write(chunk); err != nil {
+				break // stream failed, Write will fill chunks and stop
+			}
+		}
+		pw.Close()
+	}()
+	go func() {
+		err := up.stream(ctx, tenant, file.Name(), pr)
+		if err != nil {
+			pr.CloseWithError(err) // unblock writer
+		} else {
+			pr.Close()
+		}
+		s.result <- err
+	}()
+	return s
+}
+
+// Write always writes to the file, but only to the stream until it fails
+// or falls behind
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if s.err == nil {
+		chunk := make([]byte, len(p))
+		copy(chunk, p)
+		select {
+		case s.chunks <- chunk:
+		default:
+			s.err = errStreamBehind
+			s.cancel()
+		}
+	}
+	return n, nil
+}
+
+// finish ends the stream and waits for the upload result. The stream is
+// canceled if it doesn't complete within streamFinishTimeout.
+func (s *streamWriter) finish() error {
+	close(s.chunks)
+	defer s.cancel()
+
+	timer := time.NewTimer(streamFinishTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-s.result:
+	case <-timer.C:
+		s.cancel()
+		err = <-s.result
+	}
+	if err == nil {
+		err = s.err
+	}
+	return err
+}
+
+// streamed cleans up after a bucket file was successfully streamed
+func (m *manager) streamed(tenant, file string, numRecs int) {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		m.fileLogger(tenant, file).Warnf("unable to remove file %s: %v", file, err)
+	}
+	org, env, _ := getOrgAndEnvFromTenant(tenant)
+	countLabels := prometheus.Labels{"org": org, "env": env, "status": "uploaded"}
+	m.metrics.recordsCount.With(countLabels).Add(float64(numRecs))
+	m.health.Success()
+	m.fileLogger(tenant, file).Debugf("streamed file: %s", file)
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamUploads(t *testing.T) {
+	tm := newTestManager(t, Options{
+		StreamUploads: true,
+	})
+	tm.Start()
+	defer tm.Close()
+
+	flush := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tm.Flush(ctx); err != nil {
+			t.Fatalf("Flush(): %v", err)
+		}
+	}
+
+	// streamed, never staged
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	flush()
+	if pushes := tm.fs.pushesForTenant(testTenant); len(pushes) != 1 || len(pushes[0].records) != 2 {
+		t.Errorf("want 1 push of 2 records, got: %v", pushes)
+	}
+	if f := filesIn(tm.getTempDir(testTenant)); len(f) != 0 {
+		t.Errorf("want no temp files, got: %v", f)
+	}
+
+	// failed stream falls back to staging
+	tm.fs.lock.Lock()
+	tm.fs.failUpload = http.StatusInternalServerError
+	tm.fs.lock.Unlock()
+	if err := tm.SendRecords(tm.authContext, tm.records); err != nil {
+		t.Fatalf("SendRecords(): %s", err)
+	}
+	tm.stageAllBucketsWait()
+	tm.fs.lock.Lock()
+	tm.fs.failUpload = 0
+	tm.fs.lock.Unlock()
+	flush()
+	if got := tm.fs.uploadedRecords(testTenant); len(got) != 3 {
+		t.Errorf("want 3 records uploaded, got %d", len(got))
+	}
+}
+
+// slowStreamUploader never reads its stream until canceled
+type slowStreamUploader struct {
+	*saasUploader
+}
+
+func (u slowStreamUploader) stream(ctx context.Context, tenant, fileName string, body io.Reader) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStreamWriterSlowUpload(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := newStreamWriter(slowStreamUploader{}, testTenant, f)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*streamBufferSize; i++ {
+			if _, err := s.Write([]byte("record\n")); err != nil {
+				t.Errorf("Write(): %v", err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() should not block on a slow stream")
+	}
+
+	if err := s.finish(); err == nil {
+		t.Errorf("want error from abandoned stream")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(2 * streamBufferSize * len("record\n")); fi.Size() != want {
+		t.Errorf("want %d bytes in file, got %d", want, fi.Size())
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+)
+
+// An uploadJob is an upload of a file for a tenant
+type uploadJob struct {
+	tenant string
+	file   string
+	work   util.WorkFunc
+}
+
+type uploadResult struct {
+	job   uploadJob
+	retry bool // job failed and should be retried after backoff
+}
+
+// An uploadQueue holds a queue of jobs per tenant and dispatches them to
+// workers round-robin across tenants. Each tenant has its own backoff, so
+// a failing tenant waits without holding a worker or delaying others.
+// Once limit jobs are queued or in flight, the newest job of the tenant
+// with the most queued jobs is passed to overflow.
+type uploadQueue struct {
+	in       chan uploadJob
+	out      chan uploadJob
+	results  chan uploadResult
+	limit    int
+	backoff  util.Backoff // cloned for each tenant
+	overflow func(uploadJob)
+}
+
+// tenantQueue is the dispatch state for a tenant
+type tenantQueue struct {
+	jobs    []uploadJob
+	backoff util.Backoff
+	ready   time.Time // not dispatched before
+}
+
+// newUploadQueue starts an uploadQueue, close in to stop it. Once in is
+// closed and all jobs are done, out is closed.
+func newUploadQueue(limit int, backoff util.Backoff, overflow func(uploadJob)) *uploadQueue {
+	q := &uploadQueue{
+		in:       make(chan uploadJob),
+		out:      make(chan uploadJob),
+		results:  make(chan uploadResult),
+		limit:    limit,
+		backoff:  backoff,
+		overflow: overflow,
+	}
+	go q.run()
+	return q
+}
+
+// done must be called by workers when a job received from out is done
+func (q *uploadQueue) done(job uploadJob, retry bool) {
+	q.results <- uploadResult{job: job, retry: retry}
+}
+
+func (q *uploadQueue) run() {
+	tenants := map[string]*tenantQueue{}
+	var order []string // round-robin order of tenants
+	next := 0          // index into order to start next dispatch
+	size := 0          // jobs queued or in flight
+	in := q.in
+
+	for in != nil || size > 0 {
+		// find next job ready to dispatch
+		var out chan uploadJob
+		var job uploadJob
+		var picked int
+		var wake time.Time
+		now := time.Now()
+		for i := 0; i < len(order); i++ {
+			idx := (next + i) % len(order)
+			t := tenants[order[idx]]
+			if len(t.jobs) == 0 {
+				continue
+			}
+			if t.ready.After(now) {
+				if wake.IsZero() || t.ready.Before(wake) {
+					wake = t.ready
+				}
+				continue
+			}
+			out = q.out
+			job = t.jobs[0]
+			picked = idx
+			break
+		}
+		var timer *time.Timer
+		var wakeChan <-chan time.Time
+		if out == nil && !wake.IsZero() {
+			timer = time.NewTimer(wake.Sub(now))
+			wakeChan = timer.C
+		}
+
+		select {
+		case j, ok := <-in:
+			if !ok {
+				in = nil
+				break
+			}
+			t, ok := tenants[j.tenant]
+			if !ok {
+				t = &tenantQueue{backoff: q.backoff.Clone()}
+				tenants[j.tenant] = t
+				order = append(order, j.tenant)
+			}
+			if size < q.limit {
+				size++
+				t.jobs = append(t.jobs, j)
+				break
+			}
+			// full, drop newest from the largest queue
+			largest := t
+			for _, other := range tenants {
+				if len(other.jobs) > len(largest.jobs) {
+					largest = other
+				}
+			}
+			if largest != t && len(largest.jobs) > 0 {
+				dropped := largest.jobs[len(largest.jobs)-1]
+				largest.jobs = largest.jobs[:len(largest.jobs)-1]
+				t.jobs = append(t.jobs, j)
+				j = dropped
+			}
+			go q.overflow(j)
+
+		case out <- job:
+			t := tenants[job.tenant]
+			t.jobs = t.jobs[1:]
+			next = picked + 1
+
+		case r := <-q.results:
+			t := tenants[r.job.tenant]
+			if r.retry {
+				t.jobs = append([]uploadJob{r.job}, t.jobs...)
+				t.ready = time.Now().Add(t.backoff.Duration())
+			} else {
+				size--
+				t.backoff.Reset()
+				t.ready = time.Time{}
+			}
+
+		case <-wakeChan:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	close(q.out)
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+)
+
+func TestUploadQueueFairness(t *testing.T) {
+	backoff := util.NewExponentialBackoff(time.Hour, time.Hour, 2, false)
+	q := newUploadQueue(10, backoff, func(uploadJob) {
+		t.Errorf("unexpected overflow")
+	})
+
+	// single worker
+	var lock sync.Mutex
+	var ran []string
+	go func() {
+		for job := range q.out {
+			err := job.work(context.Background())
+			lock.Lock()
+			ran = append(ran, job.tenant)
+			lock.Unlock()
+			q.done(job, err != nil)
+		}
+	}()
+
+	fail := func(ctx context.Context) error { return errors.New("fail") }
+	succeed := func(ctx context.Context) error { return nil }
+	q.in <- uploadJob{tenant: "bad", work: fail}
+	q.in <- uploadJob{tenant: "bad", work: fail}
+	for i := 0; i < 3; i++ {
+		q.in <- uploadJob{tenant: "good", work: succeed}
+	}
+
+	// "bad" is backing off for an hour, "good" must not wait for it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(ran)
+		lock.Unlock()
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want 4 jobs run, got: %v", ran)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if ran[0] != "bad" {
+		t.Errorf("want bad first, got: %v", ran)
+	}
+	for _, tenant := range ran[1:] {
+		if tenant != "good" {
+			t.Errorf("want only good after bad failed, got: %v", ran)
+		}
+	}
+}
+
+func TestUploadQueueOverflow(t *testing.T) {
+	var lock sync.Mutex
+	var overflowed []string
+	q := newUploadQueue(3, util.DefaultExponentialBackoff(), func(job uploadJob) {
+		lock.Lock()
+		defer lock.Unlock()
+		overflowed = append(overflowed, job.file)
+	})
+
+	work := func(ctx context.Context) error { return nil }
+	q.in <- uploadJob{tenant: "busy", file: "busy1", work: work}
+	q.in <- uploadJob{tenant: "busy", file: "busy2", work: work}
+	q.in <- uploadJob{tenant: "quiet", file: "quiet1", work: work}
+	q.in <- uploadJob{tenant: "quiet", file: "quiet2", work: work} // drops newest from busy
+	q.in <- uploadJob{tenant: "quiet", file: "quiet3", work: work} // quiet is now largest, drops incoming
+	close(q.in)
+
+	var ran []string
+	for job := range q.out {
+		ran = append(ran, job.file)
+		q.done(job, false)
+	}
+
+	want := []string{"busy1", "quiet1", "quiet2"}
+	if len(ran) != len(want) {
+		t.Fatalf("want %v, got %v", want, ran)
+	}
+	for i := range want {
+		if ran[i] != want[i] {
+			t.Errorf("want %v, got %v", want, ran)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	sort.Strings(overflowed)
+	if want := []string{"busy2", "quiet3"}; !reflect.DeepEqual(overflowed, want) {
+		t.Errorf("want overflow %v, got: %v", want, overflowed)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+)
+
+// ContextSender is implemented by a Manager that stops waiting to accept
+// records when a context is done. A Manager from NewManager implements it.
+type ContextSender interface {
+	// SendRecordsWithContext is SendRecords, but returns early if ctx is done
+	SendRecordsWithContext(ctx context.Context, authContext *auth.Context, records []Record) error
+}
+
+// SendRecordsWithContext calls m.SendRecordsWithContext if m is a
+// ContextSender. Otherwise, it calls m.SendRecords unless ctx is done.
+func SendRecordsWithContext(ctx context.Context, m Manager, authContext *auth.Context, records []Record) error {
+	if cs, ok := m.(ContextSender); ok {
+		return cs.SendRecordsWithContext(ctx, authContext, records)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.SendRecords(authContext, records)
+}
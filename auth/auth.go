@@ -18,22 +18,29 @@ package auth
 // Authenticate function.
 
 import (
+	contex "context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/introspection"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/key"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // A Manager wraps all things related to auth processing
 type Manager interface {
 	Close()
 	Authenticate(ctx context.Context, apiKey string, claims map[string]interface{}, apiKeyClaimKey string) (*Context, error)
+	Health() health.Status
 }
 
 // ErrNoAuth is an error because of missing auth
@@ -54,18 +61,64 @@ func NewManager(options Options) (Manager, error) {
 	if err := options.validate(); err != nil {
 		return nil, err
 	}
+	mapper, err := newClaimMapper(options.ClaimMappings)
+	if err != nil {
+		return nil, err
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.Named("auth")
+	}
 	jwtVerifier := jwt.NewVerifier(jwt.VerifierOptions{
-		Providers: options.JWTProviders,
-	})
-	v := key.NewVerifier(key.VerifierOpts{
-		JwtVerifier: jwtVerifier,
-		Client:      options.Client,
-		CacheTTL:    options.APIKeyCacheDuration,
-		Org:         options.Org,
+		Providers:   options.JWTProviders,
+		Revocations: options.Revocations,
 	})
+	var v key.Verifier
+	if !options.LocalAPIKeysOnly {
+		v = key.NewVerifier(key.VerifierOpts{
+			JwtVerifier:    jwtVerifier,
+			Client:         options.Client,
+			CacheTTL:       options.APIKeyCacheDuration,
+			Org:            options.Org,
+			TracerProvider: options.TracerProvider,
+			Metrics:        options.Metrics,
+			Logger:         options.Logger,
+			Revocations:    options.Revocations,
+			MaxStale:       options.APIKeyMaxStale,
+		})
+	}
+	if options.LocalAPIKeysFile != "" {
+		if v, err = key.NewLocalVerifier(key.LocalVerifierOpts{
+			File:        options.LocalAPIKeysFile,
+			Fallback:    v,
+			Logger:      options.Logger,
+			Revocations: options.Revocations,
+		}); err != nil {
+			return nil, err
+		}
+	}
 	am := &manager{
 		jwtVerifier: jwtVerifier,
 		keyVerifier: v,
+		logger:      logger.WithFields(log.Fields{"org": options.Org}),
+		revocations: options.Revocations,
+		claimMapper: mapper,
+	}
+	if options.IntrospectionEndpoint != nil {
+		iv, err := introspection.NewVerifier(introspection.VerifierOpts{
+			Endpoint:       options.IntrospectionEndpoint,
+			Client:         options.Client,
+			ClientID:       options.IntrospectionClientID,
+			ClientSecret:   options.IntrospectionClientSecret,
+			CacheTTL:       options.IntrospectionCacheDuration,
+			TracerProvider: options.TracerProvider,
+			Logger:         options.Logger,
+			Revocations:    options.Revocations,
+		})
+		if err != nil {
+			return nil, err
+		}
+		am.introspectionVerifier = iv
 	}
 	am.start()
 	return am, nil
@@ -73,8 +126,12 @@ func NewManager(options Options) (Manager, error) {
 
 // An Manager handles all things related to authentication.
 type manager struct {
-	jwtVerifier jwt.Verifier
-	keyVerifier key.Verifier
+	jwtVerifier           jwt.Verifier
+	keyVerifier           key.Verifier
+	introspectionVerifier introspection.Verifier // nil if not configured
+	logger                log.StructuredLogger
+	revocations           *revocation.List
+	claimMapper           claimMapper
 }
 
 // Close shuts down the Manager.
@@ -84,6 +141,22 @@ func (m *manager) Close() {
 	}
 }
 
+// Health aggregates the health of JWKS retrieval, API key verification and,
+// if configured, token introspection. Verifiers that are not a health.Checker
+// are left out.
+func (m *manager) Health() health.Status {
+	var statuses []health.Status
+	for _, v := range []interface{}{m.jwtVerifier, m.keyVerifier} {
+		if c, ok := v.(health.Checker); ok {
+			statuses = append(statuses, c.Health())
+		}
+	}
+	if m.introspectionVerifier != nil {
+		statuses = append(statuses, m.introspectionVerifier.Health())
+	}
+	return health.Aggregate("auth", statuses...)
+}
+
 // Authenticate constructs an Apigee context from an existing context and either
 // a set of JWT claims, or an Apigee API key.
 // The following logic applies:
@@ -94,18 +167,40 @@ func (m *manager) Close() {
 // the request will be rejected.
 func (m *manager) Authenticate(ctx context.Context, apiKey string,
 	claims map[string]interface{}, apiKeyClaimKey string) (*Context, error) {
-	if log.DebugEnabled() {
+	return m.AuthenticateWithContext(contex.Background(), ctx, apiKey, claims, apiKeyClaimKey)
+}
+
+// AuthenticateWithContext is Authenticate, but requests to Apigee to verify
+// an API key are canceled with reqCtx. If reqCtx is done, its error is returned.
+func (m *manager) AuthenticateWithContext(reqCtx contex.Context, ctx context.Context, apiKey string,
+	claims map[string]interface{}, apiKeyClaimKey string) (*Context, error) {
+	if m.logger.DebugEnabled() {
 		redacts := []interface{}{
 			claims["access_token"],
 			claims["client_id"],
 			claims[apiKeyClaimKey],
 		}
 		redactedClaims := util.SprintfRedacts(redacts, "%#v", claims)
-		log.Debugf("Authenticate: key: %v, claims: %v", util.Truncate(apiKey, 5), redactedClaims)
+		m.logger.Debugf("Authenticate: key: %v, claims: %v", util.Truncate(apiKey, 5), redactedClaims)
 	}
 
 	var authContext = &Context{Context: ctx}
 
+	// revoked jwt claims are denied, even if they carry a valid API key
+	var mappedClaims map[string]interface{}
+	var mappingError error
+	if len(claims) > 0 {
+		mappedClaims, mappingError = m.claimMapper.apply(claims)
+		revocationClaims := mappedClaims
+		if mappingError != nil {
+			revocationClaims = claims
+		}
+		if kind, revoked := m.revocations.ClaimsRevoked(revocationClaims); revoked {
+			m.logger.Debugf("jwt claims revoked by %s", kind)
+			return authContext, ErrBadAuth
+		}
+	}
+
 	// use API Key in JWT if available
 	authAttempted := false
 	var authenticationError, claimsError error
@@ -114,11 +209,13 @@ func (m *manager) Authenticate(ctx context.Context, apiKey string,
 	if claims[apiKeyClaimKey] != nil {
 		authAttempted = true
 		if apiKey, ok := claims[apiKeyClaimKey].(string); ok {
-			verifiedClaims, authenticationError = m.keyVerifier.Verify(ctx, apiKey)
+			verifiedClaims, authenticationError = key.VerifyWithContext(reqCtx, m.keyVerifier, ctx, apiKey)
 			if authenticationError == nil {
-				log.Debugf("using api key from jwt claim %s", apiKeyClaimKey)
+				m.logger.Debugf("using api key from jwt claim %s", apiKeyClaimKey)
 				authContext.APIKey = apiKey
-				claimsError = authContext.setClaims(verifiedClaims)
+				if claimsError = authContext.setClaims(verifiedClaims); claimsError == nil {
+					authContext.Stale, _ = verifiedClaims[key.StaleClaim].(bool)
+				}
 			}
 		}
 	}
@@ -126,20 +223,30 @@ func (m *manager) Authenticate(ctx context.Context, apiKey string,
 	// else, use API Key if available
 	if !authAttempted && apiKey != "" {
 		authAttempted = true
-		verifiedClaims, authenticationError = m.keyVerifier.Verify(ctx, apiKey)
+		verifiedClaims, authenticationError = key.VerifyWithContext(reqCtx, m.keyVerifier, ctx, apiKey)
 		if authenticationError == nil {
-			log.Debugf("using api key from request")
+			m.logger.Debugf("using api key from request")
 			authContext.APIKey = apiKey
-			claimsError = authContext.setClaims(verifiedClaims)
+			if claimsError = authContext.setClaims(verifiedClaims); claimsError == nil {
+				authContext.Stale, _ = verifiedClaims[key.StaleClaim].(bool)
+			}
 		}
 	}
 
+	if err := reqCtx.Err(); err != nil {
+		return authContext, err
+	}
+
 	// if we're not authenticated yet, try the jwt claims directly
 	if !authContext.isAuthenticated() && len(claims) > 0 {
-		claimsError = authContext.setClaims(claims)
-		if authAttempted && claimsError == nil {
-			log.Warnf("apiKey verification error: %s, using jwt claims", authenticationError)
-			authenticationError = nil
+		if mappingError != nil {
+			claimsError = mappingError
+		} else {
+			claimsError = authContext.setClaims(mappedClaims)
+			if authAttempted && claimsError == nil {
+				m.logger.Warnf("apiKey verification error: %s, using jwt claims", authenticationError)
+				authenticationError = nil
+			}
 		}
 		authAttempted = true
 	}
@@ -158,21 +265,60 @@ func (m *manager) Authenticate(ctx context.Context, apiKey string,
 		authenticationError = ErrNoAuth
 	}
 
-	if log.DebugEnabled() {
+	if m.logger.DebugEnabled() {
 		redacts := []interface{}{authContext.APIKey, authContext.AccessToken, authContext.ClientID}
 		redactedAC := util.SprintfRedacts(redacts, "%#v", authContext)
 		if authenticationError == nil {
-			log.Debugf("Authenticate success: %s", redactedAC)
+			m.logger.Debugf("Authenticate success: %s", redactedAC)
 		} else if authenticationError == ErrInternalError {
-			log.Debugf("Authenticate error: %s [%v]", redactedAC, internalError)
+			m.logger.Debugf("Authenticate error: %s [%v]", redactedAC, internalError)
 		} else {
-			log.Debugf("Authenticate error: %s [%v]", redactedAC, authenticationError)
+			m.logger.Debugf("Authenticate error: %s [%v]", redactedAC, authenticationError)
 		}
 	}
 
 	return authContext, authenticationError
 }
 
+// AuthenticateAccessToken constructs an Apigee context from an opaque OAuth2
+// access token by introspecting it. Requests to the introspection endpoint
+// are canceled with reqCtx. Returns ErrInternalError if no introspection
+// endpoint is configured.
+func (m *manager) AuthenticateAccessToken(reqCtx contex.Context, ctx context.Context, accessToken string) (*Context, error) {
+	var authContext = &Context{Context: ctx}
+	if accessToken == "" {
+		return authContext, ErrNoAuth
+	}
+	if m.introspectionVerifier == nil {
+		m.logger.Errorf("AuthenticateAccessToken: no introspection endpoint configured")
+		return authContext, ErrInternalError
+	}
+
+	verifiedClaims, err := m.introspectionVerifier.VerifyWithContext(reqCtx, ctx, accessToken)
+	if err != nil {
+		if reqErr := reqCtx.Err(); reqErr != nil {
+			return authContext, reqErr
+		}
+		if err != ErrBadAuth {
+			m.logger.Debugf("AuthenticateAccessToken error: %v", err)
+			err = ErrInternalError
+		}
+		return authContext, err
+	}
+	if verifiedClaims, err = m.claimMapper.apply(verifiedClaims); err != nil {
+		return authContext, err
+	}
+	if err := authContext.setClaims(verifiedClaims); err != nil {
+		return authContext, err
+	}
+
+	if m.logger.DebugEnabled() {
+		redacts := []interface{}{authContext.AccessToken, authContext.ClientID}
+		m.logger.Debugf("AuthenticateAccessToken success: %s", util.SprintfRedacts(redacts, "%#v", authContext))
+	}
+	return authContext, nil
+}
+
 func (m *manager) start() {
 	m.jwtVerifier.Start()
 }
@@ -183,10 +329,40 @@ type Options struct {
 	Client *http.Client
 	// APIKeyCacheDuration is the length of time APIKeys are cached when unable to refresh
 	APIKeyCacheDuration time.Duration
+	// APIKeyMaxStale, if set, is how long after they expire cached API keys
+	// are used while unable to refresh. Zero is no limit.
+	APIKeyMaxStale time.Duration
 	// Org is organization
 	Org string
 	// JWKSProviders
 	JWTProviders []jwt.Provider
+	// TracerProvider, if set, is used to trace requests to Apigee
+	TracerProvider trace.TracerProvider
+	// Metrics determines where auth metrics are registered
+	Metrics util.MetricsOptions
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
+	// Revocations, if set, denies revoked JWTs and API keys
+	Revocations *revocation.List
+	// IntrospectionEndpoint, if set, enables AuthenticateAccessToken using
+	// this RFC 7662 token introspection endpoint
+	IntrospectionEndpoint *url.URL
+	// IntrospectionClientID and IntrospectionClientSecret, if set, are used
+	// to authenticate to IntrospectionEndpoint
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+	// IntrospectionCacheDuration is the maximum length of time introspected
+	// tokens are cached
+	IntrospectionCacheDuration time.Duration
+	// LocalAPIKeysFile, if set, is a local store of API keys, a JSON array
+	// of key.LocalKey. API keys not in the store are verified by Apigee
+	// unless LocalAPIKeysOnly.
+	LocalAPIKeysFile string
+	// LocalAPIKeysOnly verifies API keys only with LocalAPIKeysFile
+	LocalAPIKeysOnly bool
+	// ClaimMappings, if set, map the claims of JWTs and introspected tokens
+	// to the claims used by Context
+	ClaimMappings []ClaimMapping
 }
 
 func (o *Options) validate() error {
@@ -196,5 +372,8 @@ func (o *Options) validate() error {
 	if o.Org == "" {
 		return fmt.Errorf("org is required")
 	}
+	if o.LocalAPIKeysOnly && o.LocalAPIKeysFile == "" {
+		return fmt.Errorf("local API keys file is required for local API keys only")
+	}
 	return nil
 }
@@ -15,13 +15,19 @@
 package auth
 
 import (
+	contex "context"
+	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/key"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
 	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 )
 
@@ -46,6 +52,17 @@ func (tv *testVerifier) Verify(ctx context.Context, apiKey string) (map[string]i
 	return testJWTClaims, nil
 }
 
+func (tv *testVerifier) VerifyWithContext(reqCtx contex.Context, ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	if err := reqCtx.Err(); err != nil {
+		return nil, err
+	}
+	return tv.Verify(ctx, apiKey)
+}
+
+func (tv *testVerifier) Health() health.Status {
+	return health.Status{Name: "apikeys", Ready: true}
+}
+
 func TestNewManager(t *testing.T) {
 	log.Log.SetLevel(log.Debug)
 	opts := Options{
@@ -109,6 +126,7 @@ func TestAuthenticate(t *testing.T) {
 		authMan := &manager{
 			jwtVerifier: jwtVerifier,
 			keyVerifier: tv,
+			logger:      log.Structured(nil),
 		}
 		authMan.start()
 		defer authMan.Close()
@@ -125,6 +143,38 @@ func TestAuthenticate(t *testing.T) {
 	}
 }
 
+func TestAuthenticateWithContext(t *testing.T) {
+	authMan := &manager{
+		jwtVerifier: jwt.NewVerifier(jwt.VerifierOptions{}),
+		keyVerifier: &testVerifier{},
+		logger:      log.Structured(nil),
+	}
+	authMan.start()
+	defer authMan.Close()
+
+	reqCtx, cancel := contex.WithCancel(contex.Background())
+	cancel()
+	ctx := authtest.NewContext("")
+	if _, err := authMan.AuthenticateWithContext(reqCtx, ctx, "good", testJWTClaims, ""); err != contex.Canceled {
+		t.Errorf("want %v, got %v", contex.Canceled, err)
+	}
+	if _, err := authMan.AuthenticateWithContext(contex.Background(), ctx, "good", nil, ""); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+
+	if _, err := AuthenticateWithContext(reqCtx, authMan, ctx, "good", nil, ""); err != contex.Canceled {
+		t.Errorf("want %v, got %v", contex.Canceled, err)
+	}
+	// a Manager without AuthenticateWithContext is called unless reqCtx is done
+	authenticateOnly := struct{ Manager }{authMan}
+	if _, err := AuthenticateWithContext(reqCtx, authenticateOnly, ctx, "good", nil, ""); err != contex.Canceled {
+		t.Errorf("want %v, got %v", contex.Canceled, err)
+	}
+	if _, err := AuthenticateWithContext(contex.Background(), authenticateOnly, ctx, "good", nil, ""); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
+
 func TestValidateOptions(t *testing.T) {
 	opts := Options{}
 	var err error
@@ -145,4 +195,162 @@ func TestValidateOptions(t *testing.T) {
 	if err != nil {
 		t.Errorf("wanted no error, got %v", err)
 	}
+
+	opts.LocalAPIKeysOnly = true
+	err = opts.validate()
+	if err == nil || err.Error() != "local API keys file is required for local API keys only" {
+		t.Errorf("wanted error 'local API keys file is required for local API keys only', got %v", err)
+	}
+}
+
+func TestNewManagerLocalAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	keys := `[{"key_hash": "` + revocation.HashAPIKey("local") + `", "application_name": "app", "api_product_list": ["p"]}]`
+	if err := os.WriteFile(file, []byte(keys), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(Options{
+		Client:           &http.Client{},
+		Org:              "org",
+		LocalAPIKeysFile: file,
+		LocalAPIKeysOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ac, err := m.Authenticate(authtest.NewContext(""), "local", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.ClientID != "local" || ac.Application != "app" {
+		t.Errorf("unexpected context: %#v", ac)
+	}
+	if _, err := m.Authenticate(authtest.NewContext(""), "remote", nil, ""); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+}
+
+func TestAuthenticateRevoked(t *testing.T) {
+	revocations, err := revocation.NewList(revocation.Entry{Kind: revocation.ClientID, Value: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMan := &manager{
+		jwtVerifier: jwt.NewVerifier(jwt.VerifierOptions{}),
+		keyVerifier: &testVerifier{},
+		logger:      log.Structured(nil),
+		revocations: revocations,
+	}
+	authMan.start()
+	defer authMan.Close()
+
+	ctx := authtest.NewContext("")
+	if _, err := authMan.Authenticate(ctx, "", testJWTClaims, ""); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+
+	// a revoked jwt is denied even if it carries a valid API key
+	jwtClaims := map[string]interface{}{
+		"jti":     "revoked-jti",
+		"api_key": "good",
+	}
+	if _, err := authMan.Authenticate(ctx, "", jwtClaims, "api_key"); err != nil {
+		t.Fatalf("want no error before revocation, got %v", err)
+	}
+	if err := revocations.Add(revocation.Entry{Kind: revocation.JTI, Value: "revoked-jti"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authMan.Authenticate(ctx, "", jwtClaims, "api_key"); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+}
+
+func TestAuthenticateAccessToken(t *testing.T) {
+	authMan := &manager{
+		jwtVerifier: jwt.NewVerifier(jwt.VerifierOptions{}),
+		keyVerifier: &testVerifier{},
+		logger:      log.Structured(nil),
+	}
+	authMan.start()
+	defer authMan.Close()
+	ctx := authtest.NewContext("")
+
+	if _, err := authMan.AuthenticateAccessToken(contex.Background(), ctx, "token"); err != ErrInternalError {
+		t.Errorf("without introspection want %v, got %v", ErrInternalError, err)
+	}
+
+	authMan.introspectionVerifier = &testVerifier{
+		keyErrors: map[string]error{
+			"bad":   ErrBadAuth,
+			"error": errors.New("boom"),
+		},
+	}
+	for _, test := range []struct {
+		token string
+		want  error
+	}{
+		{"", ErrNoAuth},
+		{"bad", ErrBadAuth},
+		{"error", ErrInternalError},
+	} {
+		if _, err := authMan.AuthenticateAccessToken(contex.Background(), ctx, test.token); err != test.want {
+			t.Errorf("token %q want %v, got %v", test.token, test.want, err)
+		}
+	}
+
+	ac, err := authMan.AuthenticateAccessToken(contex.Background(), ctx, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.ClientID != "hi" || ac.Application != "taco" {
+		t.Errorf("unexpected context: %#v", ac)
+	}
+	if got := authMan.Health(); len(got.Components) != 3 {
+		t.Errorf("want 3 health components, got %#v", got)
+	}
+	// verifiers without Health are left out
+	authMan.keyVerifier = struct{ key.Verifier }{&testVerifier{}}
+	if got := authMan.Health(); len(got.Components) != 2 {
+		t.Errorf("want 2 health components, got %#v", got)
+	}
+}
+
+type staleVerifier struct {
+	testVerifier
+}
+
+func (sv *staleVerifier) VerifyWithContext(reqCtx contex.Context, ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{key.StaleClaim: true}
+	for k, v := range testJWTClaims {
+		claims[k] = v
+	}
+	return claims, nil
+}
+
+func TestAuthenticateStale(t *testing.T) {
+	authMan := &manager{
+		jwtVerifier: jwt.NewVerifier(jwt.VerifierOptions{}),
+		keyVerifier: &staleVerifier{},
+		logger:      log.Structured(nil),
+	}
+	authMan.start()
+	defer authMan.Close()
+
+	ac, err := authMan.Authenticate(authtest.NewContext(""), "good", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ac.Stale {
+		t.Errorf("want stale context")
+	}
+
+	authMan.keyVerifier = &testVerifier{}
+	if ac, err = authMan.Authenticate(authtest.NewContext(""), "good", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ac.Stale {
+		t.Errorf("want fresh context")
+	}
 }
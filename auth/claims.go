@@ -0,0 +1,358 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClaimType is the type a mapped claim is coerced to
+type ClaimType string
+
+const (
+	// ClaimTypeDefault coerces to the type Context expects for the claim,
+	// other claims are not coerced
+	ClaimTypeDefault ClaimType = ""
+	// ClaimTypeString coerces to a string, arrays are joined with spaces
+	ClaimTypeString ClaimType = "string"
+	// ClaimTypeArray coerces to a []string, strings are split on spaces
+	// unless they are a JSON array
+	ClaimTypeArray ClaimType = "array"
+)
+
+// A ClaimMapping sets a claim used by Context from another claim in a token.
+// For example, a token from an IdP that puts the client in "azp" and the
+// scopes in an array can be mapped with:
+//
+//	[]ClaimMapping{
+//	  {Claim: "client_id", Path: "/azp"},
+//	  {Claim: "scope", Path: "/scp"},
+//	  {Claim: "api_product_list", Path: "/resource_access/apigee/roles"},
+//	}
+type ClaimMapping struct {
+	// Claim is the claim to set, such as client_id
+	Claim string `json:"claim"`
+	// Path locates the value in the token's claims in the manner of a JSON
+	// pointer: "/" separated names or array indexes, with "~1" for "/" and
+	// "~0" for "~" in names. If Path is not found, Claim is unchanged.
+	Path string `json:"path"`
+	// Type coerces the value, see ClaimType
+	Type ClaimType `json:"type,omitempty"`
+}
+
+// contextClaimTypes are the types of the claims used by Context
+var contextClaimTypes = map[string]ClaimType{
+	apiProductListKey:  ClaimTypeArray,
+	clientIDKey:        ClaimTypeString,
+	applicationNameKey: ClaimTypeString,
+	scopeKey:           ClaimTypeString,
+	developerEmailKey:  ClaimTypeString,
+	accessTokenKey:     ClaimTypeString,
+	customAttributeKey: ClaimTypeString,
+}
+
+// claimMapper applies a validated list of ClaimMapping
+type claimMapper []compiledMapping
+
+type compiledMapping struct {
+	claim string
+	path  []string
+	typ   ClaimType
+}
+
+func newClaimMapper(mappings []ClaimMapping) (claimMapper, error) {
+	var mapper claimMapper
+	for _, m := range mappings {
+		if m.Claim == "" {
+			return nil, fmt.Errorf("claim mapping for path %q: claim is required", m.Path)
+		}
+		if !strings.HasPrefix(m.Path, "/") {
+			return nil, fmt.Errorf("claim mapping for %s: path %q must start with /", m.Claim, m.Path)
+		}
+		typ := m.Type
+		switch typ {
+		case ClaimTypeDefault:
+			typ = contextClaimTypes[m.Claim]
+		case ClaimTypeString, ClaimTypeArray:
+		default:
+			return nil, fmt.Errorf("claim mapping for %s: invalid type %q", m.Claim, m.Type)
+		}
+		var path []string
+		for _, seg := range strings.Split(m.Path[1:], "/") {
+			path = append(path, strings.NewReplacer("~1", "/", "~0", "~").Replace(seg))
+		}
+		mapper = append(mapper, compiledMapping{
+			claim: m.Claim,
+			path:  path,
+			typ:   typ,
+		})
+	}
+	return mapper, nil
+}
+
+// apply returns claims with the mappings applied. If there are no mappings,
+// claims is returned, otherwise a copy is made.
+// claims map must not be written to: treat as const
+func (cm claimMapper) apply(claims map[string]interface{}) (map[string]interface{}, error) {
+	if len(cm) == 0 || len(claims) == 0 {
+		return claims, nil
+	}
+	mapped := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		mapped[k] = v
+	}
+	// lookups use the original claims so mappings may swap claims
+	for _, m := range cm {
+		val, ok := lookupClaim(claims, m.path)
+		if !ok {
+			continue
+		}
+		coerced, err := coerceClaim(val, m.typ)
+		if err != nil {
+			return nil, fmt.Errorf("unable to map %s to %s: %v", "/"+strings.Join(m.path, "/"), m.claim, err)
+		}
+		mapped[m.claim] = coerced
+	}
+	return mapped, nil
+}
+
+// lookupClaim follows path through nested objects and arrays
+func lookupClaim(claims map[string]interface{}, path []string) (interface{}, bool) {
+	var val interface{} = claims
+	for _, seg := range path {
+		switch v := val.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if val, ok = v[seg]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			val = v[i]
+		case []string:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			val = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return val, val != nil
+}
+
+func coerceClaim(val interface{}, typ ClaimType) (interface{}, error) {
+	switch typ {
+	case ClaimTypeString:
+		switch v := val.(type) {
+		case []string:
+			return strings.Join(v, " "), nil
+		case []interface{}:
+			strs, err := scalarsToStrings(v)
+			if err != nil {
+				return nil, err
+			}
+			return strings.Join(strs, " "), nil
+		default:
+			return scalarToString(val)
+		}
+	case ClaimTypeArray:
+		switch v := val.(type) {
+		case []string:
+			return v, nil
+		case []interface{}:
+			return scalarsToStrings(v)
+		case string:
+			if strings.HasPrefix(strings.TrimSpace(v), "[") {
+				var strs []string
+				if err := json.Unmarshal([]byte(v), &strs); err != nil {
+					return nil, err
+				}
+				return strs, nil
+			}
+			return strings.Fields(v), nil
+		default:
+			s, err := scalarToString(val)
+			if err != nil {
+				return nil, err
+			}
+			return []string{s}, nil
+		}
+	}
+	return val, nil
+}
+
+func scalarsToStrings(vals []interface{}) ([]string, error) {
+	strs := make([]string, 0, len(vals))
+	for _, v := range vals {
+		s, err := scalarToString(v)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func scalarToString(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]interface{}:
+		// objects such as custom attributes are kept as JSON
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return "", fmt.Errorf("unable to interpret: %v", val)
+}
+
+// Claims are verified claims with typed getters. Each getter returns false if
+// the claim is missing or can't be interpreted as the type.
+type Claims map[string]interface{}
+
+// Get returns the claim value as is
+func (c Claims) Get(name string) (interface{}, bool) {
+	v, ok := c[name]
+	return v, ok && v != nil
+}
+
+// String returns a string claim. Numbers and booleans are formatted.
+func (c Claims) String(name string) (string, bool) {
+	v, ok := c.Get(name)
+	if !ok {
+		return "", false
+	}
+	if _, isMap := v.(map[string]interface{}); isMap {
+		return "", false
+	}
+	s, err := scalarToString(v)
+	return s, err == nil
+}
+
+// Strings returns an array of strings claim. A string claim must be a JSON
+// array or is split on spaces.
+func (c Claims) Strings(name string) ([]string, bool) {
+	v, ok := c.Get(name)
+	if !ok {
+		return nil, false
+	}
+	strs, err := coerceClaim(v, ClaimTypeArray)
+	if err != nil {
+		return nil, false
+	}
+	return strs.([]string), true
+}
+
+// Int64 returns a numeric claim. Fractions are truncated. A string claim must
+// be a base 10 integer.
+func (c Claims) Int64(name string) (int64, bool) {
+	v, ok := c.Get(name)
+	if !ok {
+		return 0, false
+	}
+	switch n := v.(type) {
+	case float64:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// Float64 returns a numeric claim. A string claim must be a number.
+func (c Claims) Float64(name string) (float64, bool) {
+	v, ok := c.Get(name)
+	if !ok {
+		return 0, false
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Bool returns a boolean claim. A string claim must be "true" or "false".
+func (c Claims) Bool(name string) (bool, bool) {
+	v, ok := c.Get(name)
+	if !ok {
+		return false, false
+	}
+	switch b := v.(type) {
+	case bool:
+		return b, true
+	case string:
+		parsed, err := strconv.ParseBool(b)
+		return parsed, err == nil
+	}
+	return false, false
+}
+
+// Time returns a time claim. A numeric claim is seconds since the epoch as
+// used by NumericDate claims such as exp.
+func (c Claims) Time(name string) (time.Time, bool) {
+	if t, ok := c[name].(time.Time); ok {
+		return t, true
+	}
+	if secs, ok := c.Float64(name); ok {
+		return time.Unix(int64(secs), 0), true
+	}
+	return time.Time{}, false
+}
+
+// Map returns an object claim as Claims
+func (c Claims) Map(name string) (Claims, bool) {
+	switch m := c[name].(type) {
+	case map[string]interface{}:
+		return Claims(m), true
+	case Claims:
+		return m, true
+	}
+	return nil, false
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+)
+
+func TestClaimMapper(t *testing.T) {
+	mapper, err := newClaimMapper([]ClaimMapping{
+		{Claim: clientIDKey, Path: "/azp"},
+		{Claim: applicationNameKey, Path: "/app/name"},
+		{Claim: scopeKey, Path: "/scp"},
+		{Claim: apiProductListKey, Path: "/realm_access/roles"},
+		{Claim: developerEmailKey, Path: "/emails/0"},
+		{Claim: customAttributeKey, Path: "/attrs"},
+		{Claim: "tier", Path: "/a~1b~0c", Type: ClaimTypeArray},
+		{Claim: "missing", Path: "/nope/nope"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{
+		"azp":          "client",
+		"app":          map[string]interface{}{"name": "app"},
+		"scp":          []interface{}{"read", "write"},
+		"realm_access": map[string]interface{}{"roles": "p1 p2"},
+		"emails":       []interface{}{"a@b.c", "d@e.f"},
+		"attrs":        map[string]interface{}{"tier": "gold"},
+		"a/b~c":        1.0,
+	}
+	got, err := mapper.apply(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		clientIDKey:        "client",
+		applicationNameKey: "app",
+		scopeKey:           "read write",
+		apiProductListKey:  []string{"p1", "p2"},
+		developerEmailKey:  "a@b.c",
+		customAttributeKey: `{"tier":"gold"}`,
+		"tier":             []string{"1"},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(got[k], v) {
+			t.Errorf("%s want %#v, got %#v", k, v, got[k])
+		}
+	}
+	if _, ok := got["missing"]; ok {
+		t.Errorf("missing path should not be mapped")
+	}
+	if _, ok := claims[clientIDKey]; ok {
+		t.Errorf("claims must not be modified")
+	}
+
+	if got, err := mapper.apply(map[string]interface{}{"scp": []interface{}{[]interface{}{"nested"}}}); err == nil {
+		t.Errorf("want error, got %v", got)
+	}
+
+	if got, err := claimMapper(nil).apply(claims); err != nil || !reflect.DeepEqual(got, claims) {
+		t.Errorf("empty mapper should not change claims, got %v, %v", got, err)
+	}
+}
+
+func TestNewClaimMapperInvalid(t *testing.T) {
+	for _, m := range []ClaimMapping{
+		{Path: "/azp"},
+		{Claim: clientIDKey, Path: "azp"},
+		{Claim: clientIDKey, Path: "/azp", Type: "number"},
+	} {
+		if _, err := newClaimMapper([]ClaimMapping{m}); err == nil {
+			t.Errorf("%#v: want error", m)
+		}
+	}
+}
+
+func TestAuthenticateClaimMappings(t *testing.T) {
+	mapper, err := newClaimMapper([]ClaimMapping{
+		{Claim: clientIDKey, Path: "/azp"},
+		{Claim: applicationNameKey, Path: "/azp"},
+		{Claim: apiProductListKey, Path: "/products"},
+		{Claim: scopeKey, Path: "/scp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMan := &manager{
+		jwtVerifier: jwt.NewVerifier(jwt.VerifierOptions{}),
+		keyVerifier: &testVerifier{},
+		logger:      log.Structured(nil),
+		claimMapper: mapper,
+	}
+	authMan.start()
+	defer authMan.Close()
+
+	claims := map[string]interface{}{
+		"azp":      "client",
+		"products": "p1",
+		"scp":      []interface{}{"a", "b"},
+	}
+	ac, err := authMan.Authenticate(authtest.NewContext(""), "", claims, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.ClientID != "client" || ac.Application != "client" ||
+		!reflect.DeepEqual(ac.APIProducts, []string{"p1"}) || !reflect.DeepEqual(ac.Scopes, []string{"a", "b"}) {
+		t.Errorf("unexpected context: %#v", ac)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	claims := Claims{
+		"str":     "hello",
+		"num":     42.9,
+		"numstr":  "42",
+		"bool":    true,
+		"boolstr": "false",
+		"arr":     []interface{}{"a", "b"},
+		"jsonarr": `["a","b"]`,
+		"spaces":  "a b",
+		"exp":     float64(now.Unix()),
+		"time":    now,
+		"obj":     map[string]interface{}{"k": "v"},
+		"nil":     nil,
+	}
+
+	if v, ok := claims.Get("str"); !ok || v != "hello" {
+		t.Errorf("Get want hello, got %v", v)
+	}
+	if _, ok := claims.Get("nil"); ok {
+		t.Errorf("Get nil should not be ok")
+	}
+	if s, ok := claims.String("num"); !ok || s != "42.9" {
+		t.Errorf("String want 42.9, got %q", s)
+	}
+	if _, ok := claims.String("obj"); ok {
+		t.Errorf("String of object should not be ok")
+	}
+	for _, name := range []string{"arr", "jsonarr", "spaces"} {
+		if strs, ok := claims.Strings(name); !ok || !reflect.DeepEqual(strs, []string{"a", "b"}) {
+			t.Errorf("Strings %s want [a b], got %v", name, strs)
+		}
+	}
+	if i, ok := claims.Int64("num"); !ok || i != 42 {
+		t.Errorf("Int64 want 42, got %d", i)
+	}
+	if i, ok := claims.Int64("numstr"); !ok || i != 42 {
+		t.Errorf("Int64 want 42, got %d", i)
+	}
+	if _, ok := claims.Int64("str"); ok {
+		t.Errorf("Int64 of string should not be ok")
+	}
+	if f, ok := claims.Float64("num"); !ok || f != 42.9 {
+		t.Errorf("Float64 want 42.9, got %f", f)
+	}
+	if b, ok := claims.Bool("bool"); !ok || !b {
+		t.Errorf("Bool want true, got %t", b)
+	}
+	if b, ok := claims.Bool("boolstr"); !ok || b {
+		t.Errorf("Bool want false, got %t", b)
+	}
+	for _, name := range []string{"exp", "time"} {
+		if tm, ok := claims.Time(name); !ok || !tm.Equal(now) {
+			t.Errorf("Time %s want %v, got %v", name, now, tm)
+		}
+	}
+	if m, ok := claims.Map("obj"); !ok || m["k"] != "v" {
+		t.Errorf("Map want k=v, got %v", m)
+	}
+	if _, ok := claims.Map("missing"); ok {
+		t.Errorf("Map of missing should not be ok")
+	}
+}
@@ -32,6 +32,7 @@ const (
 	developerEmailKey  = "developer_email"
 	accessTokenKey     = "access_token"
 	customAttributeKey = "custom_attributes"
+	expirationKey      = "exp"
 )
 
 // A Context wraps all the various information that is needed to make requests
@@ -46,8 +47,42 @@ type Context struct {
 	DeveloperEmail   string
 	Scopes           []string
 	APIKey           string
-	CustomAttributes string
+	CustomAttributes string // raw custom attributes, see Attributes
+	Attributes       Claims // CustomAttributes parsed as a JSON object, nil if not an object
 	AnalyticsProduct string // A single product to attatch to analytics records based on matched operations.
+	Stale            bool   // API key claims were expired and served from cache as Apigee could not be reached
+	claims           Claims
+}
+
+// Claims returns a copy of all the verified claims the Context was created
+// from, including those not otherwise exposed by Context.
+func (a *Context) Claims() Claims {
+	if a.claims == nil {
+		return nil
+	}
+	return copyClaim(map[string]interface{}(a.claims)).(map[string]interface{})
+}
+
+// copyClaim returns a deep copy of the objects and arrays in a claim value
+// as claims may be shared with caches
+func copyClaim(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyClaim(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyClaim(e)
+		}
+		return c
+	case []string:
+		return append([]string(nil), v...)
+	}
+	return val
 }
 
 // if claims can't be processed, returns error and sets no fields
@@ -80,14 +115,23 @@ func (a *Context) setClaims(claims map[string]interface{}) error {
 		return fmt.Errorf("unable to interpret %s: %v", customAttributeKey, claims[customAttributeKey])
 	}
 
+	var attributes Claims
+	if customattributes != "" {
+		if err := json.Unmarshal([]byte(customattributes), &attributes); err != nil {
+			attributes = nil // not an object, only CustomAttributes is set
+		}
+	}
+
 	a.ClientID = claims[clientIDKey].(string)
 	a.Application = claims[applicationNameKey].(string)
 	a.APIProducts = products
 	a.Scopes = scopes
-	a.Expires, _ = claims[developerEmailKey].(time.Time)
+	a.Expires, _ = Claims(claims).Time(expirationKey)
 	a.DeveloperEmail, _ = claims[developerEmailKey].(string)
 	a.AccessToken, _ = claims[accessTokenKey].(string)
 	a.CustomAttributes = customattributes
+	a.Attributes = attributes
+	a.claims = claims
 
 	return nil
 }
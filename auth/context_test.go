@@ -35,6 +35,7 @@ func TestSetClaims(t *testing.T) {
 		scopeKey:           nil,
 		developerEmailKey:  "email",
 		customAttributeKey: "{\"tier\":\"standard\"}",
+		"nested":           map[string]interface{}{"key": "value"},
 	}
 	if err := c.setClaims(claims); err == nil {
 		t.Errorf("setClaims without client_id should get error")
@@ -53,6 +54,37 @@ func TestSetClaims(t *testing.T) {
 	if !reflect.DeepEqual(c.APIProducts, productsWant) {
 		t.Errorf("apiProducts want: %s, got: %v", productsWant, c.APIProducts)
 	}
+	if !c.Expires.Equal(now) {
+		t.Errorf("expires want: %v, got: %v", now, c.Expires)
+	}
+	claims[jwt.ExpirationKey] = now.Add(time.Hour)
+	if err := c.setClaims(claims); err != nil {
+		t.Errorf("valid setClaims, got: %v", err)
+	}
+	if !c.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires want: %v, got: %v", now.Add(time.Hour), c.Expires)
+	}
+	if tier, _ := c.Attributes.String("tier"); tier != "standard" {
+		t.Errorf("tier attribute want: standard, got: %v", c.Attributes)
+	}
+	if aud, _ := c.Claims().String(jwt.AudienceKey); aud != "aud" {
+		t.Errorf("aud claim want: aud, got: %v", c.Claims())
+	}
+	copied := c.Claims()
+	copied[jwt.AudienceKey] = "changed"
+	copied["nested"].(map[string]interface{})["key"] = "changed"
+	if claims[jwt.AudienceKey] != "aud" || claims["nested"].(map[string]interface{})["key"] != "value" {
+		t.Errorf("Claims() should return a copy, got: %v", claims)
+	}
+
+	claims[customAttributeKey] = "not json"
+	if err := c.setClaims(claims); err != nil {
+		t.Errorf("valid setClaims, got: %v", err)
+	}
+	if c.CustomAttributes != "not json" || c.Attributes != nil {
+		t.Errorf("unparsable custom attributes want raw only, got: %q, %v", c.CustomAttributes, c.Attributes)
+	}
+	claims[customAttributeKey] = "{\"tier\":\"standard\"}"
 
 	claimsWant := []string{"scope1", "scope2"}
 	claims[scopeKey] = "scope1 scope2"
@@ -0,0 +1,318 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package introspection verifies opaque OAuth2 access tokens using an
+// RFC 7662 token introspection endpoint.
+package introspection
+
+/*
+1. When a token check comes in, check a LRU cache.
+2. If token is cached, return cached claims until the token expires.
+3. If token is not cached, check bad token cache, return invalid if present.
+4. If token is in neither cache, make a synchronous request to the endpoint. Update good and bad caches.
+*/
+
+import (
+	contex "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/key"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
+	"github.com/apigee/apigee-remote-service-golib/v2/cache"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheTTL              = 30 * time.Minute
+	defaultCacheEvictionInterval = 10 * time.Second
+	defaultMaxCachedEntries      = 10000
+	defaultBadEntryCacheTTL      = 10 * time.Second
+	errorLogInterval             = time.Minute // repeated errors are logged once per interval
+
+	clientIDKey        = "client_id"
+	applicationNameKey = "application_name"
+	accessTokenKey     = "access_token"
+	expirationKey      = "exp"
+)
+
+// ErrBadAuth is returned for inactive tokens
+var ErrBadAuth = key.ErrBadAuth
+
+// Verifier verifies access tokens by introspection
+type Verifier interface {
+	Verify(ctx context.Context, token string) (map[string]interface{}, error)
+	// VerifyWithContext is Verify with a request context for cancellation
+	VerifyWithContext(reqCtx contex.Context, ctx context.Context, token string) (map[string]interface{}, error)
+	Health() health.Status
+}
+
+// VerifierOpts configures a Verifier
+type VerifierOpts struct {
+	// Endpoint is the RFC 7662 introspection endpoint
+	Endpoint *url.URL
+	// Client is a configured HTTPClient
+	Client *http.Client
+	// ClientID and ClientSecret, if set, authenticate to Endpoint using basic auth
+	ClientID     string
+	ClientSecret string
+	// CacheTTL is the maximum time a token is cached, tokens are never
+	// cached beyond their exp
+	CacheTTL              time.Duration
+	CacheEvictionInterval time.Duration
+	MaxCachedEntries      int
+	// TracerProvider, if set, is used to trace requests to Endpoint
+	TracerProvider trace.TracerProvider
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
+	// Revocations, if set, denies tokens and purges the cache when added to
+	Revocations *revocation.List
+}
+
+func (o VerifierOpts) validate() error {
+	if o.Endpoint == nil {
+		return fmt.Errorf("endpoint is required")
+	}
+	if o.Client == nil {
+		return fmt.Errorf("client is required")
+	}
+	return nil
+}
+
+// NewVerifier returns a Verifier for opts
+func NewVerifier(opts VerifierOpts) (Verifier, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+	if opts.CacheEvictionInterval == 0 {
+		opts.CacheEvictionInterval = defaultCacheEvictionInterval
+	}
+	if opts.MaxCachedEntries == 0 {
+		opts.MaxCachedEntries = defaultMaxCachedEntries
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Named("auth")
+	}
+	v := &verifier{
+		endpoint:       opts.Endpoint,
+		client:         opts.Client,
+		clientID:       opts.ClientID,
+		clientSecret:   opts.ClientSecret,
+		cacheTTL:       opts.CacheTTL,
+		cache:          cache.NewLRU(opts.CacheTTL, opts.CacheEvictionInterval, int32(opts.MaxCachedEntries)),
+		knownBad:       cache.NewLRU(defaultBadEntryCacheTTL, opts.CacheEvictionInterval, 100),
+		now:            time.Now,
+		tracerProvider: opts.TracerProvider,
+		health:         &health.Tracker{Name: "introspection"},
+		logger:         opts.Logger,
+		errorLogger:    log.RateLimited(opts.Logger, errorLogInterval),
+		revocations:    opts.Revocations,
+	}
+	if v.revocations != nil {
+		v.revocations.OnAdd(v.cache.RemoveAll)
+	}
+	return v, nil
+}
+
+type verifier struct {
+	endpoint       *url.URL
+	client         *http.Client
+	clientID       string
+	clientSecret   string
+	cacheTTL       time.Duration
+	cache          cache.ExpiringCache
+	knownBad       cache.ExpiringCache
+	herdBuster     singleflight.Group
+	now            func() time.Time
+	tracerProvider trace.TracerProvider
+	health         *health.Tracker
+	logger         log.StructuredLogger
+	errorLogger    log.StructuredLogger // rate limited
+	revocations    *revocation.List
+}
+
+// Health is always Ready as tokens are verified on demand. It is Degraded if
+// the most recent introspection request failed.
+func (v *verifier) Health() health.Status {
+	return v.health.Status()
+}
+
+// Verify returns the claims of an active token
+// claims map must not be written to: treat as const
+func (v *verifier) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	return v.VerifyWithContext(contex.Background(), ctx, token)
+}
+
+// VerifyWithContext returns the claims of an active token. If the token must
+// be introspected, the request is canceled with reqCtx. Inactive and revoked
+// tokens get ErrBadAuth.
+// claims map must not be written to: treat as const
+func (v *verifier) VerifyWithContext(reqCtx contex.Context, ctx context.Context, token string) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, ErrBadAuth
+	}
+	var claims map[string]interface{}
+	if cached, ok := v.cache.Get(token); ok {
+		claims = cached.(map[string]interface{})
+	} else {
+		var err error
+		if claims, err = v.singleIntrospect(reqCtx, ctx, token); err != nil {
+			return nil, err
+		}
+	}
+	if _, revoked := v.revocations.ClaimsRevoked(claims); revoked {
+		return nil, ErrBadAuth
+	}
+	return claims, nil
+}
+
+// ensures only a single request for any given token is active.
+// Waiting ends when reqCtx is done, but the shared request uses the reqCtx
+// of the caller that started it.
+func (v *verifier) singleIntrospect(reqCtx contex.Context, ctx context.Context, token string) (map[string]interface{}, error) {
+	introspect := func() (interface{}, error) {
+		return v.introspect(reqCtx, ctx, token)
+	}
+	for attempt := 0; ; attempt++ {
+		select {
+		case res := <-v.herdBuster.DoChan(token, introspect):
+			if res.Err != nil {
+				// the shared request may have been canceled by its caller, try once with ours
+				if attempt == 0 && res.Shared && reqCtx.Err() == nil && isContextError(res.Err) {
+					continue
+				}
+				if res.Err != ErrBadAuth {
+					v.errorLogger.Errorf("token introspection failed: %v", res.Err)
+				}
+				return nil, res.Err
+			}
+			return res.Val.(map[string]interface{}), nil
+
+		case <-reqCtx.Done():
+			return nil, reqCtx.Err()
+		}
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, contex.Canceled) || errors.Is(err, contex.DeadlineExceeded)
+}
+
+// use singleIntrospect() to avoid multiple active requests
+func (v *verifier) introspect(reqCtx contex.Context, ctx context.Context, token string) (claims map[string]interface{}, err error) {
+	spanCtx, span := util.Tracer(v.tracerProvider, "auth/introspection").Start(reqCtx, "apigee.auth.introspect",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(util.OrgEnv(ctx.Organization(), ctx.Environment())...))
+	defer func() { util.EndSpan(span, err) }()
+
+	if errResp, ok := v.knownBad.Get(token); ok {
+		return nil, errResp.(error)
+	}
+
+	if v.logger.DebugEnabled() {
+		v.logger.Debugf("introspecting token: %s", util.Truncate(token, 5))
+	}
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(spanCtx, http.MethodPost, v.endpoint.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if v.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+	}
+	util.InjectTraceContext(spanCtx, req)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		if reqCtx.Err() == nil {
+			v.health.Failure(err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("introspection request failed (%d): %s", resp.StatusCode, string(body))
+		v.health.Failure(err)
+		return nil, err
+	}
+	v.health.Success()
+
+	claims, err = claimsFromResponse(body, token)
+	if err != nil {
+		if errors.Is(err, ErrBadAuth) {
+			v.knownBad.Set(token, err)
+		}
+		return nil, err
+	}
+
+	ttl := v.cacheTTL
+	if exp, ok := claims[expirationKey].(time.Time); ok {
+		if untilExp := exp.Sub(v.now()); untilExp < ttl {
+			ttl = untilExp
+		}
+	}
+	if ttl > 0 {
+		v.cache.SetWithExpiration(token, claims, ttl)
+	}
+	v.knownBad.Remove(token)
+	return claims, nil
+}
+
+// claimsFromResponse returns the claims of an introspection response in the
+// form used by auth.Context: exp is a time.Time, application_name defaults
+// to client_id and access_token is token. Other members are unchanged.
+func claimsFromResponse(body []byte, token string) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrBadAuth
+	}
+	delete(claims, "active")
+
+	for _, k := range []string{"exp", "iat", "nbf"} {
+		if v, ok := claims[k].(float64); ok {
+			claims[k] = time.Unix(int64(v), 0)
+		}
+	}
+	if _, ok := claims[applicationNameKey]; !ok {
+		claims[applicationNameKey] = claims[clientIDKey]
+	}
+	claims[accessTokenKey] = token
+	return claims, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+)
+
+func introspectionServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if r.Method != http.MethodPost {
+			t.Errorf("want POST, got %s", r.Method)
+		}
+		if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		resp := map[string]interface{}{"active": false}
+		switch r.PostForm.Get("token") {
+		case "good":
+			resp = map[string]interface{}{
+				"active":           true,
+				"client_id":        "client",
+				"scope":            "read write",
+				"api_product_list": []string{"product"},
+				"exp":              time.Now().Add(time.Hour).Unix(),
+			}
+		case "expired":
+			resp = map[string]interface{}{
+				"active":    true,
+				"client_id": "client",
+				"exp":       time.Now().Add(-time.Hour).Unix(),
+			}
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Fatal(err)
+		}
+	}))
+}
+
+func TestVerify(t *testing.T) {
+	var calls int32
+	ts := introspectionServer(t, &calls)
+	defer ts.Close()
+	endpoint, _ := url.Parse(ts.URL)
+
+	revocations, err := revocation.NewList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(VerifierOpts{
+		Endpoint:     endpoint,
+		Client:       http.DefaultClient,
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Revocations:  revocations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := authtest.NewContext(ts.URL)
+
+	claims, err := v.Verify(ctx, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["client_id"] != "client" || claims["application_name"] != "client" ||
+		claims["scope"] != "read write" || claims["access_token"] != "good" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	if _, ok := claims["exp"].(time.Time); !ok {
+		t.Errorf("want exp as time.Time, got %T", claims["exp"])
+	}
+	if _, ok := claims["active"]; ok {
+		t.Errorf("active should not be a claim")
+	}
+
+	// cached
+	if _, err := v.Verify(ctx, "good"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("want 1 call, got %d", calls)
+	}
+
+	// inactive is cached as bad
+	for i := 0; i < 2; i++ {
+		if _, err := v.Verify(ctx, "bad"); err != ErrBadAuth {
+			t.Errorf("want %v, got %v", ErrBadAuth, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("want 2 calls, got %d", calls)
+	}
+
+	// expired tokens are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := v.Verify(ctx, "expired"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("want 4 calls, got %d", calls)
+	}
+
+	if _, err := v.Verify(ctx, "error"); err == nil || err == ErrBadAuth {
+		t.Errorf("want internal error, got %v", err)
+	}
+	if v.Health().Healthy() {
+		t.Errorf("want unhealthy after error")
+	}
+
+	if _, err := v.Verify(ctx, ""); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+
+	if err := revocations.Add(revocation.Entry{Kind: revocation.ClientID, Value: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(ctx, "good"); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+}
+
+func TestVerifyWithContext(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+	endpoint, _ := url.Parse(ts.URL)
+
+	v, err := NewVerifier(VerifierOpts{
+		Endpoint: endpoint,
+		Client:   http.DefaultClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := v.VerifyWithContext(reqCtx, authtest.NewContext(ts.URL), "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestVerifyWithContextShared(t *testing.T) {
+	var calls int32
+	started, block := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			select { // until the first caller gives up
+			case <-r.Context().Done():
+			case <-block:
+			}
+			return
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"active":    true,
+			"client_id": "client",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer ts.Close()
+	defer close(block)
+	endpoint, _ := url.Parse(ts.URL)
+
+	v, err := NewVerifier(VerifierOpts{
+		Endpoint: endpoint,
+		Client:   http.DefaultClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := authtest.NewContext(ts.URL)
+
+	// the first caller starts the shared request, then is canceled
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyWithContext(reqCtx, ctx, "token")
+		firstErr <- err
+	}()
+	<-started
+
+	// the second caller joins the shared request and must not fail with it
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyWithContext(context.Background(), ctx, "token")
+		secondErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if err := <-secondErr; err != nil {
+		t.Errorf("want second caller to succeed, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("want 2 calls, got %d", calls)
+	}
+}
+
+func TestNewVerifierInvalid(t *testing.T) {
+	if _, err := NewVerifier(VerifierOpts{Client: http.DefaultClient}); err == nil {
+		t.Errorf("want error without endpoint")
+	}
+	endpoint, _ := url.Parse("http://localhost")
+	if _, err := NewVerifier(VerifierOpts{Endpoint: endpoint}); err == nil {
+		t.Errorf("want error without client")
+	}
+}
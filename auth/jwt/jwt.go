@@ -23,17 +23,25 @@ package jwt
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 	"time"
 
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
 	"github.com/apigee/apigee-remote-service-golib/v2/cache"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/lestrrat-go/backoff/v2"
 	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/pkg/errors"
 )
 
+// ErrNoProvider is returned by ParseAny if no Provider matches a JWT
+var ErrNoProvider = errors.New("no provider for jwt")
+
 const (
-	acceptableSkew               = 10 * time.Second
+	defaultClockSkew             = 10 * time.Second
 	defaultCacheTTL              = 30 * time.Minute
 	defaultCacheEvictionInterval = 10 * time.Second
 	defaultMaxCachedEntries      = 10000
@@ -52,11 +60,18 @@ func NewVerifier(opts VerifierOptions) Verifier {
 	if opts.MaxCachedEntries == 0 {
 		opts.MaxCachedEntries = defaultMaxCachedEntries
 	}
-	return &verifier{
-		providers: opts.Providers,
-		cache:     cache.NewLRU(opts.CacheTTL, opts.CacheEvictionInterval, int32(opts.MaxCachedEntries)),
-		knownBad:  cache.NewLRU(defaultBadEntryCacheTTL, opts.CacheEvictionInterval, 100),
+	v := &verifier{
+		providers:   opts.Providers,
+		cache:       cache.NewLRU(opts.CacheTTL, opts.CacheEvictionInterval, int32(opts.MaxCachedEntries)),
+		knownBad:    cache.NewLRU(defaultBadEntryCacheTTL, opts.CacheEvictionInterval, 100),
+		health:      &health.Tracker{Name: "jwks"},
+		sources:     map[string]*keySource{},
+		revocations: opts.Revocations,
+	}
+	if v.revocations != nil {
+		v.revocations.OnAdd(v.cache.RemoveAll)
 	}
+	return v
 }
 
 type Verifier interface {
@@ -65,11 +80,30 @@ type Verifier interface {
 	AddProvider(provider Provider)
 	EnsureProvidersLoaded(ctx context.Context) error
 	Parse(raw string, provider Provider) (map[string]interface{}, error)
+	ParseAny(raw string) (map[string]interface{}, Provider, error)
 }
 
+// A Provider is a source of JWTs and the policy they must satisfy.
+// Keys are from the first of JWKSURL, JWKS or KeysPath that is set.
 type Provider struct {
 	JWKSURL string
 	Refresh time.Duration
+	// JWKS is an inline JWKS document
+	JWKS string
+	// KeysPath is a JWKS or PEM file, or a directory of them, checked for
+	// changes every Refresh, default 1m. PEM keys without a kid are given
+	// the file name without extension.
+	KeysPath string
+	// Issuers, if set, are the allowed values of the iss claim
+	Issuers []string
+	// Audiences, if set, are the allowed values of the aud claim, one must match
+	Audiences []string
+	// Algorithms, if set, are the allowed signing algorithms, such as "RS256"
+	Algorithms []string
+	// RequiredClaims are claims that must be present
+	RequiredClaims []string
+	// ClockSkew is allowed when checking exp, iat and nbf, default 10s
+	ClockSkew time.Duration
 }
 
 type VerifierOptions struct {
@@ -77,6 +111,8 @@ type VerifierOptions struct {
 	CacheTTL              time.Duration
 	CacheEvictionInterval time.Duration
 	MaxCachedEntries      int
+	// Revocations, if set, denies JWTs and purges the cache when added to
+	Revocations *revocation.List
 }
 
 // An verifier handles all of the various JWT authentication functionality.
@@ -84,9 +120,14 @@ type verifier struct {
 	jwks          *jwk.AutoRefresh
 	cancelContext context.Context
 	cancelFunc    context.CancelFunc
+	providersMux  sync.Mutex
 	providers     []Provider
 	cache         cache.ExpiringCache
 	knownBad      cache.ExpiringCache
+	health        *health.Tracker
+	sourcesMux    sync.Mutex
+	sources       map[string]*keySource // JWKS or KeysPath -> keys
+	revocations   *revocation.List
 }
 
 // Start begins JWKS polling. Call Stop() when done.
@@ -95,8 +136,10 @@ func (a *verifier) Start() {
 	a.jwks = jwk.NewAutoRefresh(a.cancelContext)
 
 	// initialize JWKs
+	a.providersMux.Lock()
 	providers := a.providers
 	a.providers = []Provider{}
+	a.providersMux.Unlock()
 	for _, p := range providers {
 		a.AddProvider(p)
 	}
@@ -104,15 +147,67 @@ func (a *verifier) Start() {
 
 // EnsureProvidersLoaded ensures all JWKs certs have been retrieved for the first time.
 func (a *verifier) EnsureProvidersLoaded(ctx context.Context) error {
-	for i := range a.providers {
-		p := a.providers[i]
+	for _, p := range a.providerList() {
+		if s := a.keySource(p); s != nil {
+			if _, err := s.keySet(time.Now()); err != nil {
+				a.health.Failure(err)
+				return err
+			}
+			continue
+		}
 		if _, err := a.jwks.Refresh(ctx, p.JWKSURL); err != nil {
+			a.health.Failure(err)
 			return err
 		}
 	}
 	return nil
 }
 
+// Health is Ready once the JWKS of all providers have been fetched and
+// Degraded if a fetch failed, a refresh is overdue, or key files failed
+// to reload.
+func (a *verifier) Health() health.Status {
+	status := a.health.Status()
+	providers := a.providerList()
+	if a.jwks == nil { // not started
+		status.Ready = len(providers) == 0
+		return status
+	}
+
+	refreshed := map[string]jwk.TargetSnapshot{}
+	for snap := range a.jwks.Snapshot() {
+		refreshed[snap.URL] = snap
+	}
+	now := time.Now()
+	overdue, failing := false, false
+	status.Ready = true
+	status.LastSuccess = time.Time{}
+	for _, p := range providers {
+		if s := a.keySource(p); s != nil {
+			if _, err := s.keySet(now); err != nil {
+				status.Ready = false
+			}
+			failing = failing || s.failed() != nil
+			continue
+		}
+		if p.JWKSURL == "" {
+			continue
+		}
+		snap := refreshed[p.JWKSURL]
+		if snap.LastRefresh.IsZero() {
+			status.Ready = false
+			continue
+		}
+		if status.LastSuccess.IsZero() || snap.LastRefresh.Before(status.LastSuccess) {
+			status.LastSuccess = snap.LastRefresh
+		}
+		overdue = overdue || now.After(snap.NextRefresh)
+	}
+	status.Degraded = overdue || failing ||
+		(status.LastError != nil && !status.LastErrorTime.Before(status.LastSuccess))
+	return status
+}
+
 // Stop all background tasks.
 func (a *verifier) Stop() {
 	if a != nil && a.cancelFunc != nil {
@@ -122,6 +217,13 @@ func (a *verifier) Stop() {
 
 // AddProvider adds a JWKs provider
 func (a *verifier) AddProvider(provider Provider) {
+	a.providersMux.Lock()
+	defer a.providersMux.Unlock()
+	if a.keySource(provider) != nil {
+		a.providers = append(a.providers, provider)
+		return
+	}
+
 	// JWKs url could be shared amongst providers, find min refresh
 	jwksConfigured := false
 	minRefresh := provider.Refresh
@@ -148,32 +250,158 @@ func (a *verifier) AddProvider(provider Provider) {
 }
 
 func (a *verifier) fetchJWKs(provider Provider) (jwk.Set, error) {
+	if s := a.keySource(provider); s != nil {
+		set, err := s.keySet(time.Now())
+		if err != nil {
+			a.health.Failure(err)
+		}
+		return set, err
+	}
 	if provider.JWKSURL != "" {
-		return a.jwks.Fetch(a.cancelContext, provider.JWKSURL)
+		set, err := a.jwks.Fetch(a.cancelContext, provider.JWKSURL)
+		if err != nil {
+			a.health.Failure(err)
+		}
+		return set, err
 	}
 	return nil, nil
 }
 
 // Parse and verify a JWT
-// if provider has no JWKSURL, the cert will not be verified
+// if provider has no keys, the cert will not be verified
+// if the JWT does not satisfy the policy of provider or is revoked, a *ValidationError is returned
 func (a *verifier) Parse(raw string, provider Provider) (map[string]interface{}, error) {
+	cacheKey := a.keysID(provider) + " " + provider.policyID() + " " + raw
+	if cached, ok := a.knownBad.Get(cacheKey); ok {
+		return nil, cached.(error)
+	}
+	parsed, err := a.parse(raw, provider)
+	if err == nil {
+		err = provider.validate(parsed, time.Now())
+	}
+	if err != nil {
+		// not yet valid tokens become valid, others fail the policy until it changes
+		var verr *ValidationError
+		if errors.As(err, &verr) && !errors.Is(err, ErrNotYetValid) {
+			a.knownBad.Set(cacheKey, err)
+		}
+		return nil, err
+	}
+	if kind, revoked := a.revocations.ClaimsRevoked(parsed.claims); revoked {
+		return nil, &ValidationError{Claim: string(kind), Err: ErrRevoked}
+	}
+	return parsed.claims, nil
+}
+
+// ParseAny parses and verifies a JWT using an added Provider selected by the
+// iss claim of the JWT matching its Issuers or, if none match, by the kid
+// header matching a key in its JWKS. If several match, each is tried in the
+// order added. Providers without keys are not used. Returns the Provider that
+// verified the JWT.
+func (a *verifier) ParseAny(raw string) (map[string]interface{}, Provider, error) {
+	msg, err := jws.ParseString(raw)
+	if err != nil {
+		return nil, Provider{}, errors.Wrap(err, "jws.Parse")
+	}
+	if len(msg.Signatures()) == 0 {
+		return nil, Provider{}, errors.New("jws.Parse: no signatures")
+	}
+	var payload struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		return nil, Provider{}, errors.Wrap(err, "failed to parse claims")
+	}
+	kid := msg.Signatures()[0].ProtectedHeaders().KeyID()
 
-	if cached, ok := a.knownBad.Get(raw); ok {
+	providers := a.providersFor(payload.Issuer, kid)
+	if len(providers) == 0 {
+		return nil, Provider{}, ErrNoProvider
+	}
+	for _, p := range providers {
+		var claims map[string]interface{}
+		if claims, err = a.Parse(raw, p); err == nil {
+			return claims, p, nil
+		}
+	}
+	return nil, Provider{}, err
+}
+
+// providersFor returns the providers with issuer in Issuers or, if none,
+// the providers with kid in their JWKS. Providers without keys are skipped
+// as they don't verify signatures.
+func (a *verifier) providersFor(issuer, kid string) []Provider {
+	var withKeys []Provider
+	for _, p := range a.providerList() {
+		if p.hasKeys() {
+			withKeys = append(withKeys, p)
+		}
+	}
+	var matched []Provider
+	for _, p := range withKeys {
+		if issuer != "" && contains(p.Issuers, issuer) {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) > 0 || kid == "" {
+		return matched
+	}
+	for _, p := range withKeys {
+		if set, err := a.fetchJWKs(p); err == nil && set != nil {
+			if _, ok := set.LookupKeyID(kid); ok {
+				matched = append(matched, p)
+			}
+		}
+	}
+	return matched
+}
+
+// providerList returns a copy of the providers as AddProvider may append
+func (a *verifier) providerList() []Provider {
+	a.providersMux.Lock()
+	defer a.providersMux.Unlock()
+	return append([]Provider(nil), a.providers...)
+}
+
+// hasKeys returns true if the provider has a source of keys
+func (p Provider) hasKeys() bool {
+	return p.JWKSURL != "" || p.JWKS != "" || p.KeysPath != ""
+}
+
+// parse and verify the signature of a JWT, results are cached by JWKS
+func (a *verifier) parse(raw string, provider Provider) (*parsedToken, error) {
+	cacheKey := a.keysID(provider) + " " + raw
+
+	if cached, ok := a.knownBad.Get(cacheKey); ok {
 		return nil, cached.(error)
 	}
 
-	if cached, ok := a.cache.Get(raw); ok {
-		return cached.(map[string]interface{}), nil
+	if cached, ok := a.cache.Get(cacheKey); ok {
+		return cached.(*parsedToken), nil
 	}
 
-	cacheKnownBad := func(err error) (map[string]interface{}, error) {
-		a.knownBad.Set(raw, err)
+	cacheKnownBad := func(err error) (*parsedToken, error) {
+		a.knownBad.Set(cacheKey, err)
 		return nil, err
 	}
 
-	parseOptions := []jwt.ParseOption{jwt.WithAcceptableSkew(acceptableSkew), jwt.WithValidate(true)}
+	msg, err := jws.ParseString(raw)
+	if err != nil {
+		return cacheKnownBad(errors.Wrap(err, "jws.Parse"))
+	}
+	if len(msg.Signatures()) == 0 {
+		return cacheKnownBad(errors.New("jws.Parse: no signatures"))
+	}
+	alg := msg.Signatures()[0].ProtectedHeaders().Algorithm().String()
+	if len(provider.Algorithms) > 0 && !contains(provider.Algorithms, alg) {
+		// don't verify a signature with an algorithm that is not allowed
+		return nil, &ValidationError{Claim: "alg", Err: ErrAlgNotAllowed}
+	}
+
+	// claims are validated by Provider.validate
+	parseOptions := []jwt.ParseOption{jwt.WithValidate(false)}
 
-	if provider.JWKSURL != "" {
+	if provider.hasKeys() {
 		set, err := a.fetchJWKs(provider)
 		if err != nil {
 			return nil, err
@@ -193,12 +421,17 @@ func (a *verifier) Parse(raw string, provider Provider) (map[string]interface{},
 		return cacheKnownBad(errors.Wrap(err, "failed to parse claims"))
 	}
 
+	parsed := &parsedToken{
+		token:  token,
+		claims: claims,
+		alg:    alg,
+	}
 	exp := token.Expiration()
 	if exp.After(time.Now()) {
-		a.cache.SetWithExpiration(raw, claims, time.Until(exp))
+		a.cache.SetWithExpiration(cacheKey, parsed, time.Until(exp))
 	} else if exp.IsZero() {
-		a.cache.Set(raw, claims)
+		a.cache.Set(cacheKey, parsed)
 	}
 
-	return claims, nil
+	return parsed, nil
 }
@@ -18,13 +18,20 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"time"
 
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
@@ -103,6 +110,9 @@ func TestEnsureProvidersLoaded(t *testing.T) {
 	if err == nil {
 		t.Errorf("no JWKs available, expected error")
 	}
+	if h := jwtVerifier.(health.Checker).Health(); h.Ready || !h.Degraded || h.LastError == nil {
+		t.Errorf("want not ready and degraded, got %#v", h)
+	}
 
 	fail = false
 	err = jwtVerifier.EnsureProvidersLoaded(context.Background())
@@ -113,6 +123,9 @@ func TestEnsureProvidersLoaded(t *testing.T) {
 	if err != nil {
 		t.Errorf("good JWT and JWKs should not get error: %v", err)
 	}
+	if h := jwtVerifier.(health.Checker).Health(); !h.Ready || h.Degraded || h.LastSuccess.IsZero() {
+		t.Errorf("want ready and not degraded, got %#v", h)
+	}
 }
 
 func TestGoodAndBadJWT(t *testing.T) {
@@ -175,6 +188,323 @@ func TestGoodAndBadJWT(t *testing.T) {
 	}
 }
 
+func TestProviderPolicy(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(sendGoodJWKsHandler(privateKey, t))
+	defer ts.Close()
+
+	jwtVerifier := NewVerifier(VerifierOptions{})
+	jwtVerifier.Start()
+	defer jwtVerifier.Stop()
+
+	good, err := generateJWT(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := generateExpiredJWT(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc     string
+		jwt      string
+		provider Provider
+		wantErr  error
+	}{
+		{"no policy", good, Provider{}, nil},
+		{"allowed", good, Provider{
+			Issuers:        []string{"https://theganyo1-eval-test.apigee.net/remote-service/token"},
+			Audiences:      []string{"other", "remote-service-client"},
+			Algorithms:     []string{"RS256"},
+			RequiredClaims: []string{"client_id", "api_product_list"},
+		}, nil},
+		{"bad issuer", good, Provider{Issuers: []string{"other"}}, ErrIssuerNotAllowed},
+		{"bad audience", good, Provider{Audiences: []string{"other"}}, ErrAudienceNotAllowed},
+		{"bad alg", good, Provider{Algorithms: []string{"ES256"}}, ErrAlgNotAllowed},
+		{"missing claim", good, Provider{RequiredClaims: []string{"missing"}}, ErrMissingClaim},
+		{"expired", expired, Provider{}, ErrExpired},
+		{"expired within skew", expired, Provider{ClockSkew: 5 * time.Minute}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			provider := test.provider
+			provider.JWKSURL = ts.URL
+			jwtVerifier.AddProvider(provider)
+
+			_, err := jwtVerifier.Parse(test.jwt, provider)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Errorf("want no error, got: %v", err)
+				}
+				return
+			}
+			var ve *ValidationError
+			if !errors.As(err, &ve) || !errors.Is(err, test.wantErr) {
+				t.Errorf("want ValidationError %v, got: %v", test.wantErr, err)
+			}
+
+			// known bad
+			knownBad := jwtVerifier.(*verifier).knownBad
+			hits := knownBad.Stats().Hits
+			if _, err := jwtVerifier.Parse(test.jwt, provider); !errors.Is(err, test.wantErr) {
+				t.Errorf("want cached %v, got: %v", test.wantErr, err)
+			}
+			if knownBad.Stats().Hits != hits+1 {
+				t.Errorf("want %v from known bad cache", test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAny(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts1 := httptest.NewServer(jwksHandler(t, key1, "1"))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(jwksHandler(t, key2, "2"))
+	defer ts2.Close()
+
+	p1 := Provider{JWKSURL: ts1.URL, Issuers: []string{"issuer1"}}
+	p2 := Provider{JWKSURL: ts2.URL}
+	noKeys := Provider{Issuers: []string{"issuer3"}}
+	jwtVerifier := NewVerifier(VerifierOptions{
+		Providers: []Provider{p1, p2, noKeys},
+	})
+	jwtVerifier.Start()
+	defer jwtVerifier.Stop()
+
+	tests := []struct {
+		desc    string
+		key     *rsa.PrivateKey
+		kid     string
+		issuer  string
+		want    string // JWKSURL
+		wantErr error
+	}{
+		{"by issuer", key1, "1", "issuer1", ts1.URL, nil},
+		{"by kid", key2, "2", "issuer2", ts2.URL, nil},
+		{"unknown kid", key2, "3", "issuer2", "", ErrNoProvider},
+		{"issuer wrong key", key2, "2", "issuer1", "", nil},
+		{"issuer without keys", key2, "2", "issuer3", ts2.URL, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			raw := signJWT(t, test.key, test.kid, test.issuer)
+			claims, p, err := jwtVerifier.ParseAny(raw)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("want error, got provider %s", p.JWKSURL)
+				} else if test.wantErr != nil && err != test.wantErr {
+					t.Errorf("want %v, got: %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no error, got: %v", err)
+			}
+			if p.JWKSURL != test.want {
+				t.Errorf("want provider %s, got %s", test.want, p.JWKSURL)
+			}
+			if claims["iss"] != test.issuer {
+				t.Errorf("want iss %s, got %v", test.issuer, claims["iss"])
+			}
+		})
+	}
+
+	// providers may be added while parsing
+	raw := signJWT(t, key1, "1", "issuer1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			jwtVerifier.AddProvider(Provider{JWKSURL: ts1.URL, Issuers: []string{"issuer1"}})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, _, err := jwtVerifier.ParseAny(raw); err != nil {
+			t.Errorf("want no error, got: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestKeySources(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub1, err := jwk.New(&key1.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pub1.Set("kid", "1")
+	jwks, err := json.Marshal(map[string][]jwk.Key{"keys": {pub1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePEM := func(name string, key *rsa.PrivateKey) {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePEM("1.pem", key1)
+
+	inline := Provider{JWKS: string(jwks)}
+	files := Provider{KeysPath: dir, Refresh: time.Nanosecond}
+	missing := Provider{KeysPath: filepath.Join(dir, "missing")}
+	jwtVerifier := NewVerifier(VerifierOptions{
+		Providers: []Provider{inline, files},
+	})
+	jwtVerifier.Start()
+	defer jwtVerifier.Stop()
+
+	if err := jwtVerifier.EnsureProvidersLoaded(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h := jwtVerifier.(health.Checker).Health(); !h.Ready {
+		t.Errorf("want ready, got %#v", h)
+	}
+
+	if _, err := jwtVerifier.Parse(signJWT(t, key1, "1", "iss"), inline); err != nil {
+		t.Errorf("inline: %v", err)
+	}
+	if _, err := jwtVerifier.Parse(signJWT(t, key2, "1", "iss"), inline); err == nil {
+		t.Errorf("inline: want error for wrong key")
+	}
+	if _, err := jwtVerifier.Parse(signJWT(t, key1, "1", "iss"), files); err != nil {
+		t.Errorf("files: %v", err)
+	}
+	jwt2 := signJWT(t, key2, "2", "iss")
+	if _, err := jwtVerifier.Parse(jwt2, files); err == nil {
+		t.Errorf("files: want error for unknown kid")
+	}
+
+	// new files are loaded, new jwt as jwt2 is known bad
+	writePEM("2.pem", key2)
+	jwt2 = signJWT(t, key2, "2", "iss2")
+	if _, err := jwtVerifier.Parse(jwt2, files); err != nil {
+		t.Errorf("files: %v", err)
+	}
+
+	// invalid files keep the previous keys and degrade health
+	if err := os.WriteFile(filepath.Join(dir, "3.pem"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtVerifier.Parse(signJWT(t, key2, "2", "iss3"), files); err != nil {
+		t.Errorf("files: want previous keys, got %v", err)
+	}
+	if h := jwtVerifier.(health.Checker).Health(); !h.Ready || !h.Degraded || h.LastError == nil {
+		t.Errorf("want ready and degraded, got %#v", h)
+	}
+
+	jwtVerifier.AddProvider(missing)
+	if _, err := jwtVerifier.Parse(jwt2, missing); err == nil {
+		t.Errorf("missing: want error")
+	}
+	if h := jwtVerifier.(health.Checker).Health(); h.Ready || h.LastError == nil {
+		t.Errorf("want not ready with error, got %#v", h)
+	}
+}
+
+func TestRevokedJWT(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(sendGoodJWKsHandler(privateKey, t))
+	defer ts.Close()
+
+	revocations := &revocation.List{}
+	provider := Provider{JWKSURL: ts.URL}
+	jwtVerifier := NewVerifier(VerifierOptions{
+		Providers:   []Provider{provider},
+		Revocations: revocations,
+	})
+	jwtVerifier.Start()
+	defer jwtVerifier.Stop()
+
+	jwt, err := generateJWT(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtVerifier.Parse(jwt, provider); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := revocations.Add(revocation.Entry{Kind: revocation.JTI, Value: "29e2320b-787c-4625-8599-acc5e05c68d0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := jwtVerifier.(*verifier).cache.Get(provider.JWKSURL + " " + jwt); ok {
+		t.Errorf("want cache purged")
+	}
+	_, err = jwtVerifier.Parse(jwt, provider)
+	if !errors.Is(err, ErrRevoked) {
+		t.Errorf("want %v, got: %v", ErrRevoked, err)
+	}
+}
+
+// signJWT returns a JWT signed by privateKey with kid in the header
+func signJWT(t *testing.T, privateKey *rsa.PrivateKey, kid, issuer string) string {
+	key, err := jwk.New(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid != "" {
+		if err := key.Set("kid", kid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, issuer)
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Minute).Unix())
+	payload, err := jwt.Sign(token, jwa.RS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+// jwksHandler serves the public key of privateKey with kid
+func jwksHandler(t *testing.T, privateKey *rsa.PrivateKey, kid string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := jwk.New(&privateKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := key.Set("kid", kid); err != nil {
+			t.Fatal(err)
+		}
+		if err := key.Set("alg", jwa.RS256.String()); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]jwk.Key{"keys": {key}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func generateJWT(privateKey *rsa.PrivateKey) (string, error) {
 
 	key, err := jwk.New(privateKey)
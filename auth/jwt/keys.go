@@ -0,0 +1,187 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/pkg/errors"
+)
+
+const defaultKeysPathRefresh = time.Minute
+
+// A keySource is a key set from an inline JWKS or from files
+type keySource struct {
+	id       string        // unique, used in cache keys
+	jwks     string        // inline JWKS, if set
+	path     string        // file or directory, if set
+	interval time.Duration // between checks of path for changes
+	mu       sync.Mutex
+	set      jwk.Set
+	err      error
+	version  string // of files last loaded
+	checked  time.Time
+	health   *health.Tracker // records failed loads, if set
+}
+
+// keySet returns the keys, reloading files if changed. If reloading fails,
+// the previous keys are returned and the error is recorded in health.
+func (s *keySource) keySet(now time.Time) (jwk.Set, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jwks != "" {
+		if s.set == nil && s.err == nil {
+			s.set, s.err = jwk.ParseString(s.jwks)
+		}
+		return s.set, s.err
+	}
+
+	if !s.checked.IsZero() && now.Sub(s.checked) < s.interval {
+		return s.set, s.err
+	}
+	s.checked = now
+	files, version, err := keyFiles(s.path)
+	if err == nil && version != s.version {
+		var set jwk.Set
+		if set, err = readKeyFiles(files); err == nil {
+			s.set, s.version = set, version
+		}
+	}
+	if s.err = err; err != nil && s.health != nil {
+		s.health.Failure(err)
+	}
+	if s.set == nil {
+		return nil, s.err
+	}
+	return s.set, nil // previous keys are kept if reloading failed
+}
+
+// failed returns the error of the most recent load, nil if it succeeded
+func (s *keySource) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// keyFiles returns the files at path, a file or a directory, and a
+// version that changes if any of the files change
+func keyFiles(path string) ([]string, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+			return nil, "", err
+		}
+		sort.Strings(files)
+	}
+	var version strings.Builder
+	var keyFiles []string
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		keyFiles = append(keyFiles, f)
+		fmt.Fprintf(&version, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return keyFiles, version.String(), nil
+}
+
+// readKeyFiles reads the JWKS or PEM keys in files. PEM keys without a kid
+// are given the file name without extension as kid.
+func readKeyFiles(files []string) (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+		pem := !bytes.HasPrefix(data, []byte("{"))
+		keys, err := jwk.Parse(data, jwk.WithPEM(pem))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid keys in %s", f)
+		}
+		for i := 0; i < keys.Len(); i++ {
+			key, _ := keys.Get(i)
+			if pem && key.KeyID() == "" {
+				kid := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+				if err := key.Set(jwk.KeyIDKey, kid); err != nil {
+					return nil, err
+				}
+			}
+			set.Add(key)
+		}
+	}
+	return set, nil
+}
+
+// keySource returns the keySource for the JWKS or KeysPath of provider,
+// nil if neither is set
+func (a *verifier) keySource(provider Provider) *keySource {
+	var name string
+	switch {
+	case provider.JWKSURL != "":
+		return nil
+	case provider.JWKS != "":
+		name = "jwks:" + provider.JWKS
+	case provider.KeysPath != "":
+		name = "path:" + provider.KeysPath
+	default:
+		return nil
+	}
+
+	a.sourcesMux.Lock()
+	defer a.sourcesMux.Unlock()
+	if s, ok := a.sources[name]; ok {
+		return s
+	}
+	interval := provider.Refresh
+	if interval <= 0 {
+		interval = defaultKeysPathRefresh
+	}
+	s := &keySource{
+		id:       fmt.Sprintf("keys#%d", len(a.sources)),
+		jwks:     provider.JWKS,
+		path:     provider.KeysPath,
+		interval: interval,
+		health:   a.health,
+	}
+	a.sources[name] = s
+	return s
+}
+
+// keysID identifies the keys of provider in cache keys
+func (a *verifier) keysID(provider Provider) string {
+	if s := a.keySource(provider); s != nil {
+		return s.id
+	}
+	return provider.JWKSURL
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+)
+
+// Errors wrapped by a ValidationError
+var (
+	ErrExpired            = errors.New("token is expired")
+	ErrNotYetValid        = errors.New("token is not yet valid")
+	ErrIssuerNotAllowed   = errors.New("issuer not allowed")
+	ErrAudienceNotAllowed = errors.New("audience not allowed")
+	ErrAlgNotAllowed      = errors.New("signing algorithm not allowed")
+	ErrMissingClaim       = errors.New("required claim missing")
+	ErrRevoked            = errors.New("token is revoked")
+)
+
+// ValidationError is returned by Parse if a JWT is not valid for the
+// policy of its Provider. Use errors.Is to check the reason.
+type ValidationError struct {
+	// Claim is the claim or header that failed validation
+	Claim string
+	// Err is one of the Err values above
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Claim, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// parsedToken is a JWT with a verified signature
+type parsedToken struct {
+	token  jwt.Token
+	claims map[string]interface{}
+	alg    string
+}
+
+// clockSkew returns the skew allowed for time claims
+func (p Provider) clockSkew() time.Duration {
+	if p.ClockSkew == 0 {
+		return defaultClockSkew
+	}
+	return p.ClockSkew
+}
+
+// policyID identifies the policy of p in cache keys
+func (p Provider) policyID() string {
+	return fmt.Sprintf("%q%q%q%q%s", p.Issuers, p.Audiences, p.Algorithms, p.RequiredClaims, p.clockSkew())
+}
+
+// validate checks t against the policy of p
+func (p Provider) validate(t *parsedToken, now time.Time) error {
+	if len(p.Algorithms) > 0 && !contains(p.Algorithms, t.alg) {
+		return &ValidationError{Claim: "alg", Err: ErrAlgNotAllowed}
+	}
+
+	// same semantics as jwt.Validate
+	skew := p.clockSkew()
+	now = now.Truncate(time.Second)
+	if exp := t.token.Expiration(); !exp.IsZero() && !now.Before(exp.Truncate(time.Second).Add(skew)) {
+		return &ValidationError{Claim: jwt.ExpirationKey, Err: ErrExpired}
+	}
+	if iat := t.token.IssuedAt(); !iat.IsZero() && now.Before(iat.Truncate(time.Second).Add(-skew)) {
+		return &ValidationError{Claim: jwt.IssuedAtKey, Err: ErrNotYetValid}
+	}
+	if nbf := t.token.NotBefore(); !nbf.IsZero() && !now.After(nbf.Truncate(time.Second).Add(-skew)) {
+		return &ValidationError{Claim: jwt.NotBeforeKey, Err: ErrNotYetValid}
+	}
+
+	if len(p.Issuers) > 0 && !contains(p.Issuers, t.token.Issuer()) {
+		return &ValidationError{Claim: jwt.IssuerKey, Err: ErrIssuerNotAllowed}
+	}
+	if len(p.Audiences) > 0 {
+		allowed := false
+		for _, aud := range t.token.Audience() {
+			if contains(p.Audiences, aud) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &ValidationError{Claim: jwt.AudienceKey, Err: ErrAudienceNotAllowed}
+		}
+	}
+	for _, claim := range p.RequiredClaims {
+		if t.claims[claim] == nil {
+			return &ValidationError{Claim: claim, Err: ErrMissingClaim}
+		}
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package key
+
+import (
+	contex "context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	jwx "github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+)
+
+const defaultLocalReloadInterval = 10 * time.Second
+
+// LocalKey is an API key in a local key store. Only the hash of the API key
+// is stored.
+type LocalKey struct {
+	// KeyHash is the hex encoded SHA-256 of the API key, see revocation.HashAPIKey
+	KeyHash string `json:"key_hash"`
+	// ClientID defaults to the API key, as in Apigee
+	ClientID         string            `json:"client_id,omitempty"`
+	Application      string            `json:"application_name"`
+	DeveloperEmail   string            `json:"developer_email,omitempty"`
+	APIProducts      []string          `json:"api_product_list"`
+	CustomAttributes map[string]string `json:"custom_attributes,omitempty"`
+	// ExpiresAt, if set, is when the API key is no longer valid
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (k LocalKey) validate() error {
+	if len(k.KeyHash) != 64 {
+		return fmt.Errorf("key_hash must be a hex encoded SHA-256, got %q", k.KeyHash)
+	}
+	if k.Application == "" {
+		return fmt.Errorf("application_name is required for key_hash %s", k.KeyHash)
+	}
+	return nil
+}
+
+// claims returns the claims Apigee would return for apiKey
+func (k LocalKey) claims(apiKey string) (map[string]interface{}, error) {
+	clientID := k.ClientID
+	if clientID == "" {
+		clientID = apiKey
+	}
+	products := k.APIProducts
+	if products == nil {
+		products = []string{}
+	}
+	claims := map[string]interface{}{
+		"client_id":        clientID,
+		"application_name": k.Application,
+		"api_product_list": products,
+	}
+	if k.DeveloperEmail != "" {
+		claims["developer_email"] = k.DeveloperEmail
+	}
+	if len(k.CustomAttributes) > 0 {
+		attrs, err := json.Marshal(k.CustomAttributes)
+		if err != nil {
+			return nil, err
+		}
+		claims["custom_attributes"] = string(attrs)
+	}
+	if !k.ExpiresAt.IsZero() {
+		claims[jwx.ExpirationKey] = k.ExpiresAt
+	}
+	return claims, nil
+}
+
+// LocalVerifierOpts configures a Verifier backed by a local key store
+type LocalVerifierOpts struct {
+	// File, if set, is a JSON array of LocalKey. It is reloaded when changed.
+	File string
+	// Keys are verified in addition to those in File
+	Keys []LocalKey
+	// ReloadInterval is how often File is checked for changes
+	ReloadInterval time.Duration
+	// Fallback, if set, verifies API keys that are not in the local store
+	Fallback Verifier
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
+	// Revocations, if set, denies API keys
+	Revocations *revocation.List
+}
+
+// NewLocalVerifier returns a Verifier for the API keys in a local key store.
+// Returns an error if opts.File can't be loaded.
+func NewLocalVerifier(opts LocalVerifierOpts) (Verifier, error) {
+	if opts.File == "" && len(opts.Keys) == 0 {
+		return nil, fmt.Errorf("file or keys are required")
+	}
+	if opts.ReloadInterval == 0 {
+		opts.ReloadInterval = defaultLocalReloadInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Named("key")
+	}
+	inline, err := indexKeys(opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	lv := &localVerifier{
+		file:        opts.File,
+		inline:      inline,
+		interval:    opts.ReloadInterval,
+		fallback:    opts.Fallback,
+		now:         time.Now,
+		health:      &health.Tracker{Name: "localapikeys", RequireSuccess: opts.File != ""},
+		logger:      opts.Logger,
+		revocations: opts.Revocations,
+	}
+	if lv.file != "" {
+		if err := lv.reload(lv.now()); err != nil {
+			return nil, err
+		}
+	}
+	return lv, nil
+}
+
+type localVerifier struct {
+	file        string
+	inline      map[string]LocalKey
+	interval    time.Duration
+	fallback    Verifier
+	now         func() time.Time
+	health      *health.Tracker
+	logger      log.StructuredLogger
+	revocations *revocation.List
+
+	mu      sync.Mutex
+	keys    map[string]LocalKey // from file
+	version string              // of file last loaded
+	checked time.Time
+}
+
+// Health is Ready once File is loaded and Degraded if the most recent reload
+// failed. If there is a Fallback that is a health.Checker, its health is included.
+func (v *localVerifier) Health() health.Status {
+	status := v.health.Status()
+	if c, ok := v.fallback.(health.Checker); ok {
+		return health.Aggregate("apikeys", status, c.Health())
+	}
+	return status
+}
+
+// Verify returns the claims of an API key in the local store
+// claims map must not be written to: treat as const
+func (v *localVerifier) Verify(ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	return v.VerifyWithContext(contex.Background(), ctx, apiKey)
+}
+
+// VerifyWithContext returns the claims of an API key in the local store. If
+// the key isn't in the store, it is verified by the Fallback with reqCtx.
+// claims map must not be written to: treat as const
+func (v *localVerifier) VerifyWithContext(reqCtx contex.Context, ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	if apiKey == "" || v.revocations.APIKeyRevoked(apiKey) {
+		return nil, ErrBadAuth
+	}
+	k, ok := v.lookup(revocation.HashAPIKey(apiKey))
+	if !ok {
+		if v.fallback != nil {
+			return VerifyWithContext(reqCtx, v.fallback, ctx, apiKey)
+		}
+		return nil, ErrBadAuth
+	}
+	if !k.ExpiresAt.IsZero() && !v.now().Before(k.ExpiresAt) {
+		return nil, ErrBadAuth
+	}
+	claims, err := k.claims(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, revoked := v.revocations.ClaimsRevoked(claims); revoked {
+		return nil, ErrBadAuth
+	}
+	return claims, nil
+}
+
+// lookup finds a key by hash, reloading the file if due
+func (v *localVerifier) lookup(hash string) (LocalKey, bool) {
+	if k, ok := v.inline[hash]; ok {
+		return k, true
+	}
+	if v.file == "" {
+		return LocalKey{}, false
+	}
+	now := v.now()
+	v.mu.Lock()
+	due := now.Sub(v.checked) >= v.interval
+	v.mu.Unlock()
+	if due {
+		if err := v.reload(now); err != nil {
+			v.logger.Errorf("reloading API keys from %s: %v", v.file, err)
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	k, ok := v.keys[hash]
+	return k, ok
+}
+
+// reload reads the file if it changed. On error, previous keys are kept.
+func (v *localVerifier) reload(now time.Time) (err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.checked.IsZero() && now.Sub(v.checked) < v.interval {
+		return nil
+	}
+	v.checked = now
+	defer func() { v.health.Record(err) }()
+
+	fi, err := os.Stat(v.file)
+	if err != nil {
+		return err
+	}
+	version := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+	if version == v.version {
+		return nil
+	}
+	data, err := os.ReadFile(v.file)
+	if err != nil {
+		return err
+	}
+	var keys []LocalKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return errors.Wrapf(err, "parsing %s", v.file)
+	}
+	indexed, err := indexKeys(keys)
+	if err != nil {
+		return errors.Wrapf(err, "invalid key in %s", v.file)
+	}
+	v.keys, v.version = indexed, version
+	v.logger.Infof("loaded %d API keys from %s", len(indexed), v.file)
+	return nil
+}
+
+// indexKeys validates keys and maps them by lower case hash
+func indexKeys(keys []LocalKey) (map[string]LocalKey, error) {
+	indexed := make(map[string]LocalKey, len(keys))
+	for _, k := range keys {
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		indexed[strings.ToLower(k.KeyHash)] = k
+	}
+	return indexed, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package key
+
+import (
+	contex "context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+)
+
+type fallbackVerifier struct {
+	calls int
+}
+
+func (f *fallbackVerifier) Verify(ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	return f.VerifyWithContext(contex.Background(), ctx, apiKey)
+}
+
+func (f *fallbackVerifier) VerifyWithContext(reqCtx contex.Context, ctx context.Context, apiKey string) (map[string]interface{}, error) {
+	f.calls++
+	if apiKey == "remote" {
+		return map[string]interface{}{"client_id": "remote"}, nil
+	}
+	return nil, ErrBadAuth
+}
+
+func (f *fallbackVerifier) Health() health.Status {
+	return health.Status{Name: "apikeys", Ready: true}
+}
+
+func writeLocalKeys(t *testing.T, file string, keys ...LocalKey) {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalVerifier(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	writeLocalKeys(t, file, LocalKey{
+		KeyHash:          revocation.HashAPIKey("key1"),
+		Application:      "app1",
+		DeveloperEmail:   "dev@example.com",
+		APIProducts:      []string{"product1"},
+		CustomAttributes: map[string]string{"tier": "gold"},
+	}, LocalKey{
+		KeyHash:     revocation.HashAPIKey("expired"),
+		Application: "app2",
+		ExpiresAt:   time.Now().Add(-time.Hour),
+	})
+
+	revocations, err := revocation.NewList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewLocalVerifier(LocalVerifierOpts{
+		File:        file,
+		Keys:        []LocalKey{{KeyHash: revocation.HashAPIKey("inline"), ClientID: "client", Application: "app3"}},
+		Revocations: revocations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv := v.(*localVerifier)
+	ctx := authtest.NewContext("")
+
+	claims, err := v.Verify(ctx, "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"client_id":         "key1",
+		"application_name":  "app1",
+		"developer_email":   "dev@example.com",
+		"api_product_list":  []string{"product1"},
+		"custom_attributes": `{"tier":"gold"}`,
+	}
+	if !reflect.DeepEqual(claims, want) {
+		t.Errorf("want %v, got %v", want, claims)
+	}
+
+	if claims, err := v.Verify(ctx, "inline"); err != nil || claims["client_id"] != "client" {
+		t.Errorf("inline key: %v, %v", claims, err)
+	}
+	for _, apiKey := range []string{"", "expired", "unknown"} {
+		if _, err := v.Verify(ctx, apiKey); err != ErrBadAuth {
+			t.Errorf("%q want %v, got %v", apiKey, ErrBadAuth, err)
+		}
+	}
+	if !v.(health.Checker).Health().Healthy() {
+		t.Errorf("want healthy, got %#v", v.(health.Checker).Health())
+	}
+
+	// reload on change, keeping previous keys on error
+	writeLocalKeys(t, file, LocalKey{
+		KeyHash:     revocation.HashAPIKey("key2"),
+		Application: "app2",
+	})
+	lv.now = func() time.Time { return time.Now().Add(defaultLocalReloadInterval) }
+	if _, err := v.Verify(ctx, "key2"); err != nil {
+		t.Errorf("want reloaded key2, got %v", err)
+	}
+	if _, err := v.Verify(ctx, "key1"); err != ErrBadAuth {
+		t.Errorf("want key1 removed, got %v", err)
+	}
+	if err := os.WriteFile(file, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lv.now = func() time.Time { return time.Now().Add(2 * defaultLocalReloadInterval) }
+	if _, err := v.Verify(ctx, "key2"); err != nil {
+		t.Errorf("want previous key2, got %v", err)
+	}
+	if v.(health.Checker).Health().Healthy() {
+		t.Errorf("want degraded after bad reload")
+	}
+
+	if err := revocations.Add(revocation.APIKey("key2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(ctx, "key2"); err != ErrBadAuth {
+		t.Errorf("revoked want %v, got %v", ErrBadAuth, err)
+	}
+}
+
+func TestLocalVerifierFallback(t *testing.T) {
+	fallback := &fallbackVerifier{}
+	v, err := NewLocalVerifier(LocalVerifierOpts{
+		Keys:     []LocalKey{{KeyHash: revocation.HashAPIKey("local"), Application: "app"}},
+		Fallback: fallback,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := authtest.NewContext("")
+
+	if _, err := v.Verify(ctx, "local"); err != nil || fallback.calls != 0 {
+		t.Errorf("local key should not use fallback: %v, %d calls", err, fallback.calls)
+	}
+	if claims, err := v.Verify(ctx, "remote"); err != nil || claims["client_id"] != "remote" {
+		t.Errorf("want remote claims, got %v, %v", claims, err)
+	}
+	if _, err := v.Verify(ctx, "bad"); err != ErrBadAuth {
+		t.Errorf("want %v, got %v", ErrBadAuth, err)
+	}
+	if got := v.(health.Checker).Health(); len(got.Components) != 2 {
+		t.Errorf("want fallback health, got %#v", got)
+	}
+	// a fallback without Health is left out
+	v, err = NewLocalVerifier(LocalVerifierOpts{
+		Keys:     []LocalKey{{KeyHash: revocation.HashAPIKey("local"), Application: "app"}},
+		Fallback: struct{ Verifier }{fallback},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.(health.Checker).Health(); len(got.Components) != 0 {
+		t.Errorf("want no fallback health, got %#v", got)
+	}
+}
+
+func TestNewLocalVerifierInvalid(t *testing.T) {
+	for _, opts := range []LocalVerifierOpts{
+		{},
+		{File: filepath.Join(t.TempDir(), "missing.json")},
+		{Keys: []LocalKey{{KeyHash: "short", Application: "app"}}},
+		{Keys: []LocalKey{{KeyHash: revocation.HashAPIKey("key")}}},
+	} {
+		if _, err := NewLocalVerifier(opts); err == nil {
+			t.Errorf("%#v: want error", opts)
+		}
+	}
+}
@@ -25,20 +25,23 @@ import (
 	"bytes"
 	contex "context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"path"
 	"sync"
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
 	"github.com/apigee/apigee-remote-service-golib/v2/cache"
 	"github.com/apigee/apigee-remote-service-golib/v2/context"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	jwx "github.com/lestrrat-go/jwx/jwt"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -49,10 +52,15 @@ const (
 	defaultCacheEvictionInterval = 10 * time.Second
 	defaultMaxCachedEntries      = 10000
 	defaultBadEntryCacheTTL      = 10 * time.Second
+	errorLogInterval             = time.Minute // repeated errors are logged once per interval
 )
 
 var ErrBadAuth = errors.New("permission denied")
 
+// StaleClaim is added to the claims returned for an API key whose cached
+// claims expired but could not yet be refreshed from Apigee
+const StaleClaim = "apigee_stale"
+
 // keyVerifier encapsulates API key verification logic.
 type Verifier interface {
 	Verify(ctx context.Context, apiKey string) (map[string]interface{}, error)
@@ -77,6 +85,13 @@ type verifierImpl struct {
 	knownBad         cache.ExpiringCache
 	checking         sync.Map
 	prometheusLabels prometheus.Labels
+	tracerProvider   trace.TracerProvider
+	metrics          *metrics
+	health           *health.Tracker
+	logger           log.StructuredLogger
+	errorLogger      log.StructuredLogger // rate limited
+	revocations      *revocation.List
+	maxStale         time.Duration
 }
 
 type VerifierOpts struct {
@@ -86,6 +101,18 @@ type VerifierOpts struct {
 	MaxCachedEntries      int
 	Client                *http.Client
 	Org                   string
+	// TracerProvider, if set, is used to trace requests to Apigee
+	TracerProvider trace.TracerProvider
+	// Metrics determines where apikey metrics are registered
+	Metrics util.MetricsOptions
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
+	// Revocations, if set, denies API keys and purges the cache when added to
+	Revocations *revocation.List
+	// MaxStale, if set, is how long after they expire cached claims may be
+	// used while they can't be refreshed. After that, the API key is verified
+	// as if it were not cached. Zero is no limit.
+	MaxStale time.Duration
 }
 
 func NewVerifier(opts VerifierOpts) Verifier {
@@ -98,27 +125,53 @@ func NewVerifier(opts VerifierOpts) Verifier {
 	if opts.MaxCachedEntries == 0 {
 		opts.MaxCachedEntries = defaultMaxCachedEntries
 	}
-	return &verifierImpl{
+	if opts.Logger == nil {
+		opts.Logger = log.Named("key")
+	}
+	logger := opts.Logger.WithFields(log.Fields{"org": opts.Org})
+	kv := &verifierImpl{
 		jwtVerifier:      opts.JwtVerifier,
 		cache:            cache.NewLRU(opts.CacheTTL, opts.CacheEvictionInterval, int32(opts.MaxCachedEntries)),
 		now:              time.Now,
 		client:           opts.Client,
 		knownBad:         cache.NewLRU(defaultBadEntryCacheTTL, opts.CacheEvictionInterval, 100),
 		prometheusLabels: prometheus.Labels{"org": opts.Org},
+		tracerProvider:   opts.TracerProvider,
+		metrics:          newMetrics(opts.Metrics),
+		health:           &health.Tracker{Name: "apikeys"},
+		logger:           logger,
+		errorLogger:      log.RateLimited(logger, errorLogInterval),
+		revocations:      opts.Revocations,
+		maxStale:         opts.MaxStale,
+	}
+	if kv.revocations != nil {
+		kv.revocations.OnAdd(kv.cache.RemoveAll)
 	}
+	return kv
+}
+
+// Health is always Ready as keys are verified on demand. It is Degraded if
+// the most recent verification request to Apigee failed.
+func (kv *verifierImpl) Health() health.Status {
+	return kv.health.Status()
 }
 
 // use singleFetchToken() to avoid multiple active requests
-func (kv *verifierImpl) fetchToken(ctx context.Context, apiKey string) (map[string]interface{}, error) {
+func (kv *verifierImpl) fetchToken(reqCtx contex.Context, ctx context.Context, apiKey string) (claims map[string]interface{}, err error) {
+	spanCtx, span := util.Tracer(kv.tracerProvider, "auth/key").Start(reqCtx, "apigee.auth.fetchToken",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(util.OrgEnv(ctx.Organization(), ctx.Environment())...))
+	defer func() { util.EndSpan(span, err) }()
+
 	if errResp, ok := kv.knownBad.Get(apiKey); ok {
-		if log.DebugEnabled() {
-			log.Debugf("fetchToken: known bad token: %s", util.Truncate(apiKey, 5))
+		if kv.logger.DebugEnabled() {
+			kv.logger.Debugf("fetchToken: known bad token: %s", util.Truncate(apiKey, 5))
 		}
 		return nil, errResp.(error)
 	}
 
-	if log.DebugEnabled() {
-		log.Debugf("fetchToken fetching: %s", util.Truncate(apiKey, 5))
+	if kv.logger.DebugEnabled() {
+		kv.logger.Debugf("fetchToken fetching: %s", util.Truncate(apiKey, 5))
 	}
 	verifyRequest := APIKeyRequest{
 		APIKey: apiKey,
@@ -130,20 +183,30 @@ func (kv *verifierImpl) fetchToken(ctx context.Context, apiKey string) (map[stri
 	body := new(bytes.Buffer)
 	_ = json.NewEncoder(body).Encode(verifyRequest)
 
-	req, err := http.NewRequest(http.MethodPost, apiURL.String(), body)
+	req, err := http.NewRequestWithContext(spanCtx, http.MethodPost, apiURL.String(), body)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	util.InjectTraceContext(spanCtx, req)
 
 	resp, err := kv.client.Do(req)
 	if err != nil {
+		if reqCtx.Err() != nil { // canceled by caller, not a problem with the key
+			return nil, err
+		}
 		kv.knownBad.Set(apiKey, err)
+		kv.health.Failure(err)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		kv.health.Failure(fmt.Errorf("verify api key status: %s", resp.Status))
+	} else {
+		kv.health.Success()
+	}
 
 	apiKeyResp := APIKeyResponse{}
 	_ = json.NewDecoder(resp.Body).Decode(&apiKeyResp)
@@ -156,7 +219,7 @@ func (kv *verifierImpl) fetchToken(ctx context.Context, apiKey string) (map[stri
 	}
 
 	// Parse will not verify empty provider
-	claims, err := kv.jwtVerifier.Parse(token, jwt.Provider{})
+	claims, err = kv.jwtVerifier.Parse(token, jwt.Provider{})
 	if err != nil {
 		err = errors.Wrap(err, "parsing jwt")
 		kv.knownBad.Set(apiKey, err)
@@ -167,29 +230,66 @@ func (kv *verifierImpl) fetchToken(ctx context.Context, apiKey string) (map[stri
 	kv.knownBad.Remove(apiKey)
 
 	stats := kv.cache.Stats()
-	prometheusAPIKeysCacheHits.With(kv.prometheusLabels).Set(float64(stats.Hits))
-	prometheusAPIKeysCacheMisses.With(kv.prometheusLabels).Set(float64(stats.Misses))
+	kv.metrics.cacheHits.With(kv.prometheusLabels).Set(float64(stats.Hits))
+	kv.metrics.cacheMisses.With(kv.prometheusLabels).Set(float64(stats.Misses))
 
 	return claims, nil
 }
 
-// ensures only a single request for any given api key is active
-func (kv *verifierImpl) singleFetchToken(ctx context.Context, apiKey string) (map[string]interface{}, error) {
+// ensures only a single request for any given api key is active.
+// Waiting ends when reqCtx is done, but the shared request uses the reqCtx
+// of the caller that started it.
+func (kv *verifierImpl) singleFetchToken(reqCtx contex.Context, ctx context.Context, apiKey string) (map[string]interface{}, error) {
 	fetch := func() (interface{}, error) {
-		return kv.fetchToken(ctx, apiKey)
+		return kv.fetchToken(reqCtx, ctx, apiKey)
 	}
-	res, err, _ := kv.herdBuster.Do(apiKey, fetch)
-	if err != nil {
-		log.Errorf("token fetching for API key failed: %v", err)
-		return nil, err
+	for attempt := 0; ; attempt++ {
+		select {
+		case res := <-kv.herdBuster.DoChan(apiKey, fetch):
+			if res.Err != nil {
+				// the shared request may have been canceled by its caller, try once with ours
+				if attempt == 0 && res.Shared && reqCtx.Err() == nil && isContextError(res.Err) {
+					continue
+				}
+				kv.errorLogger.Errorf("token fetching for API key failed: %v", res.Err)
+				return nil, res.Err
+			}
+			return res.Val.(map[string]interface{}), nil
+
+		case <-reqCtx.Done():
+			return nil, reqCtx.Err()
+		}
 	}
+}
 
-	return res.(map[string]interface{}), nil
+func isContextError(err error) bool {
+	return errors.Is(err, contex.Canceled) || errors.Is(err, contex.DeadlineExceeded)
 }
 
 // verify returns the list of claims that an API key has.
 // claims map must not be written to: treat as const
 func (kv *verifierImpl) Verify(ctx context.Context, apiKey string) (claims map[string]interface{}, err error) {
+	return kv.VerifyWithContext(contex.Background(), ctx, apiKey)
+}
+
+// VerifyWithContext returns the list of claims that an API key has. If the
+// key must be fetched from Apigee, the request is canceled with reqCtx.
+// Revoked keys get ErrBadAuth.
+// claims map must not be written to: treat as const
+func (kv *verifierImpl) VerifyWithContext(reqCtx contex.Context, ctx context.Context, apiKey string) (claims map[string]interface{}, err error) {
+	if kv.revocations.APIKeyRevoked(apiKey) {
+		return nil, ErrBadAuth
+	}
+	claims, err = kv.verify(reqCtx, ctx, apiKey)
+	if err == nil {
+		if _, revoked := kv.revocations.ClaimsRevoked(claims); revoked {
+			return nil, ErrBadAuth
+		}
+	}
+	return claims, err
+}
+
+func (kv *verifierImpl) verify(reqCtx contex.Context, ctx context.Context, apiKey string) (claims map[string]interface{}, err error) {
 	if existing, ok := kv.cache.Get(apiKey); ok {
 		claims = existing.(map[string]interface{})
 	}
@@ -198,6 +298,12 @@ func (kv *verifierImpl) Verify(ctx context.Context, apiKey string) (claims map[s
 	if claims != nil {
 		exp := claims[jwx.ExpirationKey].(time.Time)
 		ttl := exp.Sub(kv.now())
+		if kv.maxStale > 0 && -ttl >= kv.maxStale { // too stale to use
+			if kv.logger.DebugEnabled() {
+				kv.logger.Debugf("cached claims exceeded max stale: %s", util.Truncate(apiKey, 5))
+			}
+			return kv.singleFetchToken(reqCtx, ctx, apiKey)
+		}
 		if ttl <= 0 { // refresh if possible
 			if _, ok := kv.checking.Load(apiKey); !ok { // one refresh per apiKey at a time
 				kv.checking.Store(apiKey, apiKey)
@@ -209,9 +315,9 @@ func (kv *verifierImpl) Verify(ctx context.Context, apiKey string) (claims map[s
 				}
 				c, cancel := contex.WithCancel(contex.Background())
 				work := func(c contex.Context) error {
-					claims, err = kv.singleFetchToken(ctx, apiKey)
+					_, err := kv.singleFetchToken(c, ctx, apiKey)
 					if err != nil && err != ErrBadAuth {
-						log.Debugf("fetchToken error: %s", err)
+						kv.logger.Debugf("fetchToken error: %s", err)
 						return err
 					}
 					cancel()
@@ -219,28 +325,47 @@ func (kv *verifierImpl) Verify(ctx context.Context, apiKey string) (claims map[s
 					return nil
 				}
 				looper.Start(c, work, time.Minute, func(err error) error {
-					log.Errorf("Error refreshing token: %s", err)
+					kv.errorLogger.Errorf("Error refreshing token: %s", err)
 					return nil
 				})
 			}
+			return staleClaims(claims), nil
 		}
 		return claims, nil
 	}
 
 	// not found, force new request
-	return kv.singleFetchToken(ctx, apiKey)
+	return kv.singleFetchToken(reqCtx, ctx, apiKey)
 }
 
-var (
-	prometheusAPIKeysCacheHits = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "auth",
-		Name:      "apikeys_cache_hit_count",
-		Help:      "Number of apikey cache hits",
-	}, []string{"org"})
+// staleClaims returns a copy of claims with StaleClaim set
+func staleClaims(claims map[string]interface{}) map[string]interface{} {
+	stale := make(map[string]interface{}, len(claims)+1)
+	for k, v := range claims {
+		stale[k] = v
+	}
+	stale[StaleClaim] = true
+	return stale
+}
 
-	prometheusAPIKeysCacheMisses = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "auth",
-		Name:      "apikeys_cache_miss_count",
-		Help:      "Number of apikey cache misses",
-	}, []string{"org"})
-)
+// metrics are the apikey Prometheus metrics
+type metrics struct {
+	cacheHits   *prometheus.GaugeVec
+	cacheMisses *prometheus.GaugeVec
+}
+
+func newMetrics(opts util.MetricsOptions) *metrics {
+	return &metrics{
+		cacheHits: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "auth",
+			Name:      "apikeys_cache_hit_count",
+			Help:      "Number of apikey cache hits",
+		}, []string{"org"}),
+
+		cacheMisses: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "auth",
+			Name:      "apikeys_cache_miss_count",
+			Help:      "Number of apikey cache misses",
+		}, []string{"org"}),
+	}
+}
@@ -15,19 +15,24 @@
 package key
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth/jwt"
+	"github.com/apigee/apigee-remote-service-golib/v2/auth/revocation"
 	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
 	jwx "github.com/lestrrat-go/jwx/jwt"
@@ -174,6 +179,51 @@ func TestVerifyAPIKeyValid(t *testing.T) {
 	}
 }
 
+func TestVerifyAPIKeyWithContext(t *testing.T) {
+	apiKey := "testID"
+
+	handler := goodHandler(apiKey, t)
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		handler(w, r)
+	}))
+	defer ts.Close()
+
+	v, j := testVerifier(t, ts.URL, VerifierOpts{})
+	defer j.Stop()
+
+	ctx := authtest.NewContext(ts.URL)
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := VerifyWithContext(reqCtx, v, ctx, apiKey); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	close(block)
+
+	// deadline is not cached as a bad key
+	claims, err := VerifyWithContext(context.Background(), v, ctx, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["client_id"].(string) != "yBQ5eXZA8rSoipYEi1Rmn0Z8RKtkGI4H" {
+		t.Errorf("bad client_id, got: %s", claims["client_id"].(string))
+	}
+	if h := v.(health.Checker).Health(); h.Degraded {
+		t.Errorf("want not degraded, got %#v", h)
+	}
+
+	// a Verifier without VerifyWithContext is called unless reqCtx is done
+	verifyOnly := struct{ Verifier }{v}
+	if _, err := VerifyWithContext(reqCtx, verifyOnly, ctx, apiKey); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if _, err := VerifyWithContext(context.Background(), verifyOnly, ctx, apiKey); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
+
 func TestVerifyAPIKeyCacheWithClear(t *testing.T) {
 	apiKey := "testID"
 
@@ -279,6 +329,56 @@ func TestVerifyAPIKeyCacheWithExpiry(t *testing.T) {
 	}
 }
 
+func TestVerifyAPIKeyMaxStale(t *testing.T) {
+	apiKey := "testID"
+
+	// after the first verification, Apigee is unreachable
+	var called int32
+	good := goodHandler(apiKey, t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, certsPath) {
+			good(w, r)
+			return
+		}
+		if atomic.AddInt32(&called, 1) == 1 {
+			good(w, r)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.Close()
+
+	maxStale := time.Hour
+	v, j := testVerifier(t, ts.URL, VerifierOpts{MaxStale: maxStale})
+	defer j.Stop()
+	kv := v.(*verifierImpl)
+	ctx := authtest.NewContext(ts.URL)
+
+	kv.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	claims, err := v.Verify(ctx, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := claims[StaleClaim]; ok {
+		t.Errorf("fresh claims should not be stale")
+	}
+	exp := claims[jwx.ExpirationKey].(time.Time)
+
+	kv.now = func() time.Time { return exp.Add(maxStale / 2) }
+	claims, err = v.Verify(ctx, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale, _ := claims[StaleClaim].(bool); !stale {
+		t.Errorf("expired claims should be stale")
+	}
+
+	kv.now = func() time.Time { return exp.Add(maxStale) }
+	if _, err := v.Verify(ctx, apiKey); err == nil || err == ErrBadAuth {
+		t.Errorf("want fetch error beyond max stale, got %v", err)
+	}
+}
+
 func TestVerifyAPIKeyFail(t *testing.T) {
 	ts := httptest.NewServer(badHandler())
 	defer ts.Close()
@@ -333,3 +433,46 @@ func TestVerifyAPIKeyCallFail(t *testing.T) {
 		t.Errorf("error should not be %s", err.Error())
 	}
 }
+
+func TestVerifyAPIKeyRevoked(t *testing.T) {
+	apiKey := "testID"
+
+	ts := httptest.NewServer(goodHandler(apiKey, t))
+	defer ts.Close()
+
+	revocations := &revocation.List{}
+	v, j := testVerifier(t, ts.URL, VerifierOpts{Revocations: revocations})
+	defer j.Stop()
+	kv := v.(*verifierImpl)
+
+	ctx := authtest.NewContext(ts.URL)
+	if _, err := v.Verify(ctx, apiKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.cache.Get(apiKey); !ok {
+		t.Fatalf("want api key cached")
+	}
+
+	if err := revocations.Add(revocation.APIKey(apiKey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.cache.Get(apiKey); ok {
+		t.Errorf("want cache purged")
+	}
+	if _, err := v.Verify(ctx, apiKey); err != ErrBadAuth {
+		t.Errorf("want %v, got: %v", ErrBadAuth, err)
+	}
+
+	revocations.Remove(revocation.APIKey(apiKey))
+	if _, err := v.Verify(ctx, apiKey); err != nil {
+		t.Errorf("want no error, got: %v", err)
+	}
+
+	clientID := revocation.Entry{Kind: revocation.ClientID, Value: "yBQ5eXZA8rSoipYEi1Rmn0Z8RKtkGI4H"}
+	if err := revocations.Add(clientID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(ctx, apiKey); err != ErrBadAuth {
+		t.Errorf("want %v, got: %v", ErrBadAuth, err)
+	}
+}
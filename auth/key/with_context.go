@@ -0,0 +1,41 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package key
+
+import (
+	"context"
+
+	apigee "github.com/apigee/apigee-remote-service-golib/v2/context"
+)
+
+// ContextVerifier is implemented by a Verifier that cancels requests to
+// Apigee with a request context. Verifiers from this package implement it.
+type ContextVerifier interface {
+	// VerifyWithContext is Verify, but requests to Apigee are canceled with reqCtx
+	VerifyWithContext(reqCtx context.Context, ctx apigee.Context, apiKey string) (map[string]interface{}, error)
+}
+
+// VerifyWithContext calls v.VerifyWithContext if v is a ContextVerifier.
+// Otherwise, it calls v.Verify unless reqCtx is done.
+// claims map must not be written to: treat as const
+func VerifyWithContext(reqCtx context.Context, v Verifier, ctx apigee.Context, apiKey string) (map[string]interface{}, error) {
+	if cv, ok := v.(ContextVerifier); ok {
+		return cv.VerifyWithContext(reqCtx, ctx, apiKey)
+	}
+	if err := reqCtx.Err(); err != nil {
+		return nil, err
+	}
+	return v.Verify(ctx, apiKey)
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package revocation provides a deny-list of revoked JWTs and API keys
+// for the jwt and key verifiers.
+package revocation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+)
+
+const defaultPollInterval = time.Minute
+
+// Kind is the kind of value an Entry denies
+type Kind string
+
+const (
+	// JTI denies JWTs by jti claim
+	JTI Kind = "jti"
+	// ClientID denies JWTs and API keys by client_id claim
+	ClientID Kind = "client_id"
+	// APIKeyHash denies API keys by hex SHA-256 hash, see HashAPIKey
+	APIKeyHash Kind = "api_key_hash"
+)
+
+// An Entry is a revoked value
+type Entry struct {
+	Kind  Kind   `json:"kind"`
+	Value string `json:"value"`
+}
+
+func (e Entry) validate() error {
+	switch e.Kind {
+	case JTI, ClientID, APIKeyHash:
+	default:
+		return fmt.Errorf("invalid kind: %q", e.Kind)
+	}
+	if e.Value == "" {
+		return fmt.Errorf("%s value is required", e.Kind)
+	}
+	return nil
+}
+
+// HashAPIKey returns the hash of apiKey used in APIKeyHash entries
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKey returns an Entry that denies apiKey
+func APIKey(apiKey string) Entry {
+	return Entry{Kind: APIKeyHash, Value: HashAPIKey(apiKey)}
+}
+
+// A List is a deny-list of revoked JWTs and API keys. Entries are either
+// added at runtime or loaded from a polled source. The zero value is an
+// empty List.
+type List struct {
+	mu        sync.RWMutex
+	added     map[Entry]bool
+	loaded    map[Entry]bool // replaced by each poll
+	listeners []func()
+}
+
+// NewList returns a List with entries
+func NewList(entries ...Entry) (*List, error) {
+	l := &List{}
+	if err := l.Add(entries...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// OnAdd registers f to be called when entries are added, such as to purge
+// caches of verified tokens.
+func (l *List) OnAdd(f func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.listeners = append(l.listeners, f)
+}
+
+// Add entries to the List
+func (l *List) Add(entries ...Entry) error {
+	for _, e := range entries {
+		if err := e.validate(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	if l.added == nil {
+		l.added = map[Entry]bool{}
+	}
+	added := false
+	for _, e := range entries {
+		if !l.added[e] && !l.loaded[e] {
+			added = true
+		}
+		l.added[e] = true
+	}
+	listeners := l.listeners
+	l.mu.Unlock()
+
+	if added {
+		for _, f := range listeners {
+			f()
+		}
+	}
+	return nil
+}
+
+// Remove entries added to the List. Entries from a polled source are
+// only removed by the source.
+func (l *List) Remove(entries ...Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range entries {
+		delete(l.added, e)
+	}
+}
+
+// Entries returns all the entries of the List
+func (l *List) Entries() []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]Entry, 0, len(l.added)+len(l.loaded))
+	for e := range l.added {
+		entries = append(entries, e)
+	}
+	for e := range l.loaded {
+		if !l.added[e] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Revoked returns true if the List has an Entry for kind and value
+func (l *List) Revoked(kind Kind, value string) bool {
+	if l == nil || value == "" {
+		return false
+	}
+	e := Entry{kind, value}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.added[e] || l.loaded[e]
+}
+
+// APIKeyRevoked returns true if apiKey is revoked
+func (l *List) APIKeyRevoked(apiKey string) bool {
+	if l == nil || apiKey == "" {
+		return false
+	}
+	return l.Revoked(APIKeyHash, HashAPIKey(apiKey))
+}
+
+// ClaimsRevoked returns the kind of the Entry that revokes claims, if any,
+// by jti or client_id
+func (l *List) ClaimsRevoked(claims map[string]interface{}) (Kind, bool) {
+	for _, kind := range []Kind{JTI, ClientID} {
+		if v, ok := claims[string(kind)].(string); ok && l.Revoked(kind, v) {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// load replaces the loaded entries
+func (l *List) load(entries []Entry) {
+	loaded := make(map[Entry]bool, len(entries))
+	for _, e := range entries {
+		loaded[e] = true
+	}
+	l.mu.Lock()
+	added := false
+	for e := range loaded {
+		if !l.loaded[e] && !l.added[e] {
+			added = true
+		}
+	}
+	l.loaded = loaded
+	listeners := l.listeners
+	l.mu.Unlock()
+
+	if added {
+		for _, f := range listeners {
+			f()
+		}
+	}
+}
+
+// SourceOptions configures a source of entries, a JSON array of Entry
+// from either URL or File.
+type SourceOptions struct {
+	// URL is an endpoint returning entries
+	URL string
+	// Client is used for URL
+	Client *http.Client
+	// File is a file of entries
+	File string
+	// PollInterval is the time between loads, default 1m
+	PollInterval time.Duration
+}
+
+func (o SourceOptions) validate() error {
+	if (o.URL == "") == (o.File == "") {
+		return fmt.Errorf("one of url or file is required")
+	}
+	if o.URL != "" && o.Client == nil {
+		return fmt.Errorf("client is required for url")
+	}
+	return nil
+}
+
+// Poll loads entries from the source of opts, replacing the previously
+// loaded entries, every PollInterval until ctx is done.
+func (l *List) Poll(ctx context.Context, opts SourceOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	logger := log.Named("auth")
+	poller := util.Looper{
+		Backoff: util.NewExponentialBackoff(200*time.Millisecond, interval, 2, true),
+	}
+	poller.Start(ctx, func(ctx context.Context) error {
+		entries, err := opts.read(ctx)
+		if err != nil {
+			return err
+		}
+		l.load(entries)
+		logger.Debugf("loaded %d revocation entries", len(entries))
+		return nil
+	}, interval, func(err error) error {
+		logger.Errorf("Error loading revocation entries: %v", err)
+		return nil
+	})
+	return nil
+}
+
+// read entries from the source
+func (o SourceOptions) read(ctx context.Context) ([]Entry, error) {
+	var data []byte
+	var err error
+	if o.File != "" {
+		if data, err = os.ReadFile(o.File); err != nil {
+			return nil, err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := o.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("revocation request failed (%d): %s", resp.StatusCode, string(data))
+		}
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid revocation entries: %v", err)
+	}
+	for _, e := range entries {
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
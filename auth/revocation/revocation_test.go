@@ -0,0 +1,128 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	l, err := NewList(Entry{JTI, "jti1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged := 0
+	l.OnAdd(func() { purged++ })
+
+	if err := l.Add(APIKey("key1"), Entry{ClientID, "client1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(Entry{JTI, "jti1"}); err != nil { // existing
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("want 1 purge, got %d", purged)
+	}
+	if err := l.Add(Entry{"bad", "x"}); err == nil {
+		t.Errorf("want error for invalid kind")
+	}
+	if err := l.Add(Entry{JTI, ""}); err == nil {
+		t.Errorf("want error for empty value")
+	}
+
+	if !l.APIKeyRevoked("key1") || l.APIKeyRevoked("key2") {
+		t.Errorf("want key1 revoked only")
+	}
+	if kind, ok := l.ClaimsRevoked(map[string]interface{}{"client_id": "client1"}); !ok || kind != ClientID {
+		t.Errorf("want revoked by client_id, got %q %t", kind, ok)
+	}
+	if kind, ok := l.ClaimsRevoked(map[string]interface{}{"jti": "jti1", "client_id": "client2"}); !ok || kind != JTI {
+		t.Errorf("want revoked by jti, got %q %t", kind, ok)
+	}
+	if _, ok := l.ClaimsRevoked(map[string]interface{}{"jti": "jti2"}); ok {
+		t.Errorf("want not revoked")
+	}
+	if got := len(l.Entries()); got != 3 {
+		t.Errorf("want 3 entries, got %d", got)
+	}
+
+	l.Remove(Entry{JTI, "jti1"})
+	if l.Revoked(JTI, "jti1") {
+		t.Errorf("want jti1 removed")
+	}
+
+	var nilList *List
+	if nilList.APIKeyRevoked("key1") {
+		t.Errorf("nil list should revoke nothing")
+	}
+}
+
+func TestPoll(t *testing.T) {
+	entries := []Entry{{JTI, "jti1"}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(entries)
+	}))
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "revoked.json")
+	if err := os.WriteFile(file, []byte(`[{"kind":"client_id","value":"client1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		desc string
+		opts SourceOptions
+		want Entry
+	}{
+		{"url", SourceOptions{URL: ts.URL, Client: http.DefaultClient, PollInterval: time.Hour}, Entry{JTI, "jti1"}},
+		{"file", SourceOptions{File: file, PollInterval: time.Hour}, Entry{ClientID, "client1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			l := &List{}
+			purged := make(chan bool, 1)
+			l.OnAdd(func() { purged <- true })
+			if err := l.Poll(ctx, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-purged:
+			case <-time.After(5 * time.Second):
+				t.Fatal("entries not loaded")
+			}
+			if !l.Revoked(test.want.Kind, test.want.Value) {
+				t.Errorf("want %v revoked", test.want)
+			}
+		})
+	}
+
+	l := &List{}
+	if err := l.Poll(ctx, SourceOptions{}); err == nil {
+		t.Errorf("want error for no source")
+	}
+	if err := l.Poll(ctx, SourceOptions{URL: ts.URL}); err == nil {
+		t.Errorf("want error for no client")
+	}
+}
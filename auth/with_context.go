@@ -0,0 +1,49 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+
+	apigee "github.com/apigee/apigee-remote-service-golib/v2/context"
+)
+
+// ContextAuthenticator is implemented by a Manager that cancels requests to
+// Apigee with a request context. A Manager from NewManager implements it.
+type ContextAuthenticator interface {
+	// AuthenticateWithContext is Authenticate, but requests to Apigee are
+	// canceled with reqCtx
+	AuthenticateWithContext(reqCtx context.Context, ctx apigee.Context, apiKey string, claims map[string]interface{}, apiKeyClaimKey string) (*Context, error)
+}
+
+// AccessTokenAuthenticator is implemented by a Manager that authenticates
+// opaque OAuth2 access tokens. A Manager from NewManager implements it.
+type AccessTokenAuthenticator interface {
+	// AuthenticateAccessToken authenticates an access token using the
+	// configured introspection endpoint, canceling requests with reqCtx
+	AuthenticateAccessToken(reqCtx context.Context, ctx apigee.Context, accessToken string) (*Context, error)
+}
+
+// AuthenticateWithContext calls m.AuthenticateWithContext if m is a
+// ContextAuthenticator. Otherwise, it calls m.Authenticate unless reqCtx is done.
+func AuthenticateWithContext(reqCtx context.Context, m Manager, ctx apigee.Context, apiKey string, claims map[string]interface{}, apiKeyClaimKey string) (*Context, error) {
+	if ca, ok := m.(ContextAuthenticator); ok {
+		return ca.AuthenticateWithContext(reqCtx, ctx, apiKey, claims, apiKeyClaimKey)
+	}
+	if err := reqCtx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Authenticate(ctx, apiKey, claims, apiKeyClaimKey)
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// axreplay uploads a directory of staged analytics files to Apigee.
+//
+// Usage:
+//
+//	axreplay -base-url URL [-key KEY -secret SECRET | -token TOKEN] [-dry-run] [-delete] DIR
+//
+// DIR must be laid out like the analytics staging directory, with one
+// "org~env" directory per tenant.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/analytics"
+)
+
+func main() {
+	baseURL := flag.String("base-url", "", "Apigee base URL (required)")
+	key := flag.String("key", "", "remote service key for basic auth")
+	secret := flag.String("secret", "", "remote service secret for basic auth")
+	token := flag.String("token", "", "bearer token, for GCP managed Apigee")
+	dryRun := flag.Bool("dry-run", false, "validate files without uploading")
+	del := flag.Bool("delete", false, "delete files once uploaded")
+	timeout := flag.Duration("timeout", time.Minute, "timeout for each HTTP request")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] DIR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *baseURL == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	u, err := url.Parse(*baseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid base-url: %s\n", err)
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &authTransport{
+			key:    *key,
+			secret: *secret,
+			token:  *token,
+			host:   u.Host,
+			base:   http.DefaultTransport,
+		},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var records, invalid, uploaded int
+	err = analytics.Replay(ctx, flag.Arg(0), analytics.ReplayOptions{
+		Client:  client,
+		BaseURL: u,
+		DryRun:  *dryRun,
+		Delete:  *del,
+		Progress: func(p analytics.ReplayProgress) {
+			records += p.Records
+			invalid += p.Invalid
+			status := "ok"
+			switch {
+			case p.Err != nil:
+				status = fmt.Sprintf("error: %s", p.Err)
+			case p.Uploaded:
+				uploaded++
+				status = "uploaded"
+			}
+			fmt.Printf("[%d/%d] %s: %d records, %d invalid, %s\n",
+				p.Done, p.Total, p.File, p.Records, p.Invalid, status)
+		},
+	})
+	fmt.Printf("%d valid records, %d invalid records, %d files uploaded\n", records, invalid, uploaded)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// authTransport adds credentials to requests to the Apigee host.
+// Requests to other hosts, such as the signed URLs, are unchanged.
+type authTransport struct {
+	key, secret, token string
+	host               string
+	base               http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host {
+		req = req.Clone(req.Context())
+		if t.token != "" {
+			req.Header.Set("Authorization", "Bearer "+t.token)
+		} else if t.key != "" {
+			req.SetBasicAuth(t.key, t.secret)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
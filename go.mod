@@ -4,9 +4,14 @@ go 1.16
 
 require (
 	github.com/google/uuid v1.2.0
+	github.com/klauspost/compress v1.15.9
 	github.com/lestrrat-go/backoff/v2 v2.0.8
 	github.com/lestrrat-go/jwx v1.1.6
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.12.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	go.uber.org/zap v1.21.0
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
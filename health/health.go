@@ -0,0 +1,190 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health reports the readiness of the library's managers.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A Checker reports its health. All managers are Checkers.
+type Checker interface {
+	Health() Status
+}
+
+// Status is the health of a component
+type Status struct {
+	// Name of the component
+	Name string
+	// Ready is true once the component is able to serve requests
+	Ready bool
+	// Degraded is true if the most recent operation of the component failed
+	Degraded bool
+	// LastSuccess is the time of the most recent successful operation
+	LastSuccess time.Time
+	// LastError is the error of the most recent failed operation
+	LastError error
+	// LastErrorTime is the time of LastError
+	LastErrorTime time.Time
+	// Components are the statuses this Status aggregates
+	Components []Status
+}
+
+// Healthy is true if the component is ready and not degraded
+func (s Status) Healthy() bool {
+	return s.Ready && !s.Degraded
+}
+
+// MarshalJSON omits unset fields and formats LastError as a string
+func (s Status) MarshalJSON() ([]byte, error) {
+	type status struct {
+		Name          string     `json:"name"`
+		Ready         bool       `json:"ready"`
+		Degraded      bool       `json:"degraded"`
+		LastSuccess   *time.Time `json:"last_success,omitempty"`
+		LastError     string     `json:"last_error,omitempty"`
+		LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+		Components    []Status   `json:"components,omitempty"`
+	}
+	js := status{
+		Name:       s.Name,
+		Ready:      s.Ready,
+		Degraded:   s.Degraded,
+		Components: s.Components,
+	}
+	if !s.LastSuccess.IsZero() {
+		js.LastSuccess = &s.LastSuccess
+	}
+	if s.LastError != nil {
+		js.LastError = s.LastError.Error()
+	}
+	if !s.LastErrorTime.IsZero() {
+		js.LastErrorTime = &s.LastErrorTime
+	}
+	return json.Marshal(js)
+}
+
+// Aggregate combines statuses. The result is Ready if all statuses are
+// Ready and Degraded if any is Degraded. LastSuccess is the earliest of the
+// last successes, LastError is the most recent error.
+func Aggregate(name string, statuses ...Status) Status {
+	agg := Status{
+		Name:       name,
+		Ready:      true,
+		Components: statuses,
+	}
+	for _, s := range statuses {
+		agg.Ready = agg.Ready && s.Ready
+		agg.Degraded = agg.Degraded || s.Degraded
+		if !s.LastSuccess.IsZero() && (agg.LastSuccess.IsZero() || s.LastSuccess.Before(agg.LastSuccess)) {
+			agg.LastSuccess = s.LastSuccess
+		}
+		if s.LastError != nil && s.LastErrorTime.After(agg.LastErrorTime) {
+			agg.LastError = s.LastError
+			agg.LastErrorTime = s.LastErrorTime
+		}
+	}
+	return agg
+}
+
+// Handler returns an http.Handler for Kubernetes probes that responds with
+// the aggregate Status of checkers as JSON. The response is 200 OK if the
+// aggregate is Ready, 503 Service Unavailable if not. If the request has
+// a "strict" query parameter, a Degraded aggregate is also unavailable.
+func Handler(name string, checkers ...Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]Status, len(checkers))
+		for i, c := range checkers {
+			statuses[i] = c.Health()
+		}
+		agg := Aggregate(name, statuses...)
+
+		code := http.StatusOK
+		_, strict := r.URL.Query()["strict"]
+		if !agg.Ready || (strict && agg.Degraded) {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(agg)
+	})
+}
+
+// A Tracker records the outcomes of a component's operations and reports
+// them as a Status. The zero value is ready before any success. A Tracker
+// is safe for concurrent use and must not be copied.
+type Tracker struct {
+	// Name of the component
+	Name string
+	// RequireSuccess means the component is not Ready until its first success
+	RequireSuccess bool
+	// now is for testing
+	now func() time.Time
+
+	mu            sync.Mutex
+	lastSuccess   time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// Success records a successful operation
+func (t *Tracker) Success() {
+	now := t.timeNow()
+	t.mu.Lock()
+	t.lastSuccess = now
+	t.mu.Unlock()
+}
+
+// Failure records a failed operation
+func (t *Tracker) Failure(err error) {
+	now := t.timeNow()
+	t.mu.Lock()
+	t.lastError = err
+	t.lastErrorTime = now
+	t.mu.Unlock()
+}
+
+// Record records a success if err is nil, a failure otherwise
+func (t *Tracker) Record(err error) {
+	if err != nil {
+		t.Failure(err)
+	} else {
+		t.Success()
+	}
+}
+
+// Status returns the current Status
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Status{
+		Name:          t.Name,
+		Ready:         !t.RequireSuccess || !t.lastSuccess.IsZero(),
+		Degraded:      t.lastError != nil && !t.lastErrorTime.Before(t.lastSuccess),
+		LastSuccess:   t.lastSuccess,
+		LastError:     t.lastError,
+		LastErrorTime: t.lastErrorTime,
+	}
+}
+
+func (t *Tracker) timeNow() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
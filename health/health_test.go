@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := &Tracker{
+		Name:           "test",
+		RequireSuccess: true,
+		now:            func() time.Time { return now },
+	}
+
+	s := tr.Status()
+	if s.Name != "test" || s.Ready || s.Degraded {
+		t.Errorf("want not ready and not degraded, got %#v", s)
+	}
+
+	err := errors.New("failed")
+	tr.Failure(err)
+	s = tr.Status()
+	if s.Ready || !s.Degraded || s.LastError != err || !s.LastErrorTime.Equal(now) {
+		t.Errorf("want not ready and degraded, got %#v", s)
+	}
+
+	now = now.Add(time.Second)
+	tr.Record(nil)
+	s = tr.Status()
+	if !s.Ready || s.Degraded || !s.LastSuccess.Equal(now) || s.LastError != err {
+		t.Errorf("want ready and not degraded, got %#v", s)
+	}
+
+	now = now.Add(time.Second)
+	tr.Record(err)
+	s = tr.Status()
+	if !s.Ready || !s.Degraded {
+		t.Errorf("want ready and degraded, got %#v", s)
+	}
+
+	var zero Tracker
+	if s := zero.Status(); !s.Ready || s.Degraded {
+		t.Errorf("want zero Tracker ready, got %#v", s)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	err1 := errors.New("one")
+	err2 := errors.New("two")
+	a := Status{Name: "a", Ready: true, LastSuccess: time.Unix(10, 0), LastError: err1, LastErrorTime: time.Unix(5, 0)}
+	b := Status{Name: "b", Ready: true, Degraded: true, LastSuccess: time.Unix(5, 0), LastError: err2, LastErrorTime: time.Unix(8, 0)}
+	c := Status{Name: "c"}
+
+	agg := Aggregate("all", a, b)
+	if !agg.Ready || !agg.Degraded || agg.Healthy() {
+		t.Errorf("want ready and degraded, got %#v", agg)
+	}
+	if !agg.LastSuccess.Equal(time.Unix(5, 0)) {
+		t.Errorf("want earliest last success, got %s", agg.LastSuccess)
+	}
+	if agg.LastError != err2 {
+		t.Errorf("want latest error, got %v", agg.LastError)
+	}
+	if len(agg.Components) != 2 {
+		t.Errorf("want 2 components, got %d", len(agg.Components))
+	}
+
+	if agg := Aggregate("all", a, c); agg.Ready {
+		t.Errorf("want not ready, got %#v", agg)
+	}
+	if agg := Aggregate("none"); !agg.Healthy() {
+		t.Errorf("want empty aggregate healthy, got %#v", agg)
+	}
+}
+
+type testChecker Status
+
+func (c testChecker) Health() Status {
+	return Status(c)
+}
+
+func TestHandler(t *testing.T) {
+	ready := testChecker{Name: "ready", Ready: true, LastSuccess: time.Unix(10, 0)}
+	degraded := testChecker{Name: "degraded", Ready: true, Degraded: true,
+		LastError: errors.New("failed"), LastErrorTime: time.Unix(20, 0)}
+	notReady := testChecker{Name: "not ready"}
+
+	tests := []struct {
+		desc     string
+		target   string
+		checkers []Checker
+		want     int
+	}{
+		{"ready", "/", []Checker{ready}, http.StatusOK},
+		{"degraded", "/", []Checker{ready, degraded}, http.StatusOK},
+		{"degraded strict", "/?strict", []Checker{ready, degraded}, http.StatusServiceUnavailable},
+		{"not ready", "/", []Checker{ready, notReady}, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Handler("test", test.checkers...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if rec.Code != test.want {
+				t.Errorf("want status %d, got %d", test.want, rec.Code)
+			}
+
+			var body map[string]interface{}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["name"] != "test" {
+				t.Errorf("want name test, got %v", body["name"])
+			}
+			if comps, ok := body["components"].([]interface{}); !ok || len(comps) != len(test.checkers) {
+				t.Errorf("want %d components, got %v", len(test.checkers), body["components"])
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	Handler("test", degraded).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["last_error"] != "failed" {
+		t.Errorf("want last_error failed, got %v", body["last_error"])
+	}
+	if _, ok := body["last_success"]; ok {
+		t.Errorf("want no last_success, got %v", body["last_success"])
+	}
+}
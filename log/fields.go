@@ -0,0 +1,198 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fields are key/value pairs added to log messages, such as org, env,
+// tenant, quota or file.
+type Fields map[string]interface{}
+
+// Keys returns the keys of f in sorted order
+func (f Fields) Keys() []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String formats f as " key=value" pairs in key order
+func (f Fields) String() string {
+	var b strings.Builder
+	for _, k := range f.Keys() {
+		fmt.Fprintf(&b, " %s=%v", k, f[k])
+	}
+	return b.String()
+}
+
+// merge returns a new Fields with the fields of f and more, more wins
+func (f Fields) merge(more Fields) Fields {
+	merged := make(Fields, len(f)+len(more))
+	for k, v := range f {
+		merged[k] = v
+	}
+	for k, v := range more {
+		merged[k] = v
+	}
+	return merged
+}
+
+// StructuredLogger is a logger that carries Fields
+type StructuredLogger interface {
+	LoggerWithLevel
+
+	// WithFields returns a StructuredLogger that adds fields to each message
+	WithFields(fields Fields) StructuredLogger
+}
+
+// Structured returns l as a StructuredLogger. If l is not a StructuredLogger,
+// fields are appended to each message as " key=value" pairs. If l is nil, the
+// global Log at the time of each message is used.
+func Structured(l LoggerWithLevel) StructuredLogger {
+	if s, ok := l.(StructuredLogger); ok {
+		return s
+	}
+	return &fieldsLogger{base: l}
+}
+
+// WithFields returns a StructuredLogger that writes to the global Log and
+// adds fields to each message.
+func WithFields(fields Fields) StructuredLogger {
+	return Structured(nil).WithFields(fields)
+}
+
+// fieldsLogger adds Fields to the messages of a LoggerWithLevel
+type fieldsLogger struct {
+	base   LoggerWithLevel // nil for global Log
+	name   string          // set if Named
+	fields Fields
+}
+
+func (f *fieldsLogger) logger() LoggerWithLevel {
+	if f.base != nil {
+		return f.base
+	}
+	return Log
+}
+
+func (f *fieldsLogger) WithFields(fields Fields) StructuredLogger {
+	return &fieldsLogger{
+		base:   f.base,
+		name:   f.name,
+		fields: f.fields.merge(fields),
+	}
+}
+
+func (f *fieldsLogger) log(lvl Level, format string, args ...interface{}) {
+	if f.Level() < lvl {
+		return
+	}
+	l := f.logger()
+	var w Logger = l
+	if _, ok := f.namedLevel(); ok {
+		// already filtered by the Named Level
+		w = unleveled(l)
+	}
+	if s, ok := l.(StructuredLogger); ok && len(f.fields) > 0 {
+		w = s.WithFields(f.fields)
+	} else if len(f.fields) > 0 {
+		format, args = "%s%s", []interface{}{fmt.Sprintf(format, args...), f.fields}
+	}
+	switch lvl {
+	case Debug:
+		w.Debugf(format, args...)
+	case Info:
+		w.Infof(format, args...)
+	case Warn:
+		w.Warnf(format, args...)
+	default:
+		w.Errorf(format, args...)
+	}
+}
+
+func (f *fieldsLogger) Debugf(format string, args ...interface{}) {
+	f.log(Debug, format, args...)
+}
+
+func (f *fieldsLogger) Infof(format string, args ...interface{}) {
+	f.log(Info, format, args...)
+}
+
+func (f *fieldsLogger) Warnf(format string, args ...interface{}) {
+	f.log(Warn, format, args...)
+}
+
+func (f *fieldsLogger) Errorf(format string, args ...interface{}) {
+	f.log(Error, format, args...)
+}
+
+// namedLevel returns the Level set for the name of a Named logger, if any
+func (f *fieldsLogger) namedLevel() (Level, bool) {
+	if f.name == "" {
+		return 0, false
+	}
+	return LevelFor(f.name)
+}
+
+func (f *fieldsLogger) Level() Level {
+	if lvl, ok := f.namedLevel(); ok {
+		return lvl
+	}
+	return f.logger().Level()
+}
+
+// SetLevel sets the Level for the name of a Named logger, otherwise
+// the Level of the underlying logger
+func (f *fieldsLogger) SetLevel(level Level) {
+	if f.name != "" {
+		SetLevelFor(f.name, level)
+		return
+	}
+	f.logger().SetLevel(level)
+}
+
+func (f *fieldsLogger) DebugEnabled() bool {
+	if lvl, ok := f.namedLevel(); ok {
+		return lvl.DebugEnabled()
+	}
+	return f.logger().DebugEnabled()
+}
+
+func (f *fieldsLogger) InfoEnabled() bool {
+	if lvl, ok := f.namedLevel(); ok {
+		return lvl.InfoEnabled()
+	}
+	return f.logger().InfoEnabled()
+}
+
+func (f *fieldsLogger) WarnEnabled() bool {
+	if lvl, ok := f.namedLevel(); ok {
+		return lvl.WarnEnabled()
+	}
+	return f.logger().WarnEnabled()
+}
+
+func (f *fieldsLogger) ErrorEnabled() bool {
+	if lvl, ok := f.namedLevel(); ok {
+		return lvl.ErrorEnabled()
+	}
+	return f.logger().ErrorEnabled()
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWithFields(t *testing.T) {
+	rl := &recordLogger{}
+	l := Structured(&LevelWrapper{rl, Info})
+
+	l.WithFields(Fields{"org": "o", "env": "e"}).WithFields(Fields{"env": "e2", "file": "f"}).Warnf("warn %d", 1)
+	l.WithFields(Fields{"org": "o"}).Debugf("debug")
+	l.Infof("info")
+
+	want := []string{"warn 1 env=e2 file=f org=o", "info"}
+	if fmt.Sprint(rl.prints) != fmt.Sprint(want) {
+		t.Errorf("want %q, got %q", want, rl.prints)
+	}
+}
+
+func TestWithFieldsGlobal(t *testing.T) {
+	defer func(l LoggerWithLevel) { Log = l }(Log)
+
+	// fields loggers created before Log is set use the new Log
+	l := WithFields(Fields{"tenant": "o~e"})
+	rl := &recordLogger{}
+	Log = &LevelWrapper{rl, Debug}
+
+	l.Errorf("error")
+	if l.Level() != Debug {
+		t.Errorf("want level %s, got %s", Debug, l.Level())
+	}
+	want := []string{"error tenant=o~e"}
+	if fmt.Sprint(rl.prints) != fmt.Sprint(want) {
+		t.Errorf("want %q, got %q", want, rl.prints)
+	}
+}
+
+// recordLogger records formatted messages
+type recordLogger struct {
+	prints []string
+}
+
+func (r *recordLogger) Debugf(format string, args ...interface{}) {
+	r.prints = append(r.prints, fmt.Sprintf(format, args...))
+}
+
+func (r *recordLogger) Infof(format string, args ...interface{}) {
+	r.prints = append(r.prints, fmt.Sprintf(format, args...))
+}
+
+func (r *recordLogger) Warnf(format string, args ...interface{}) {
+	r.prints = append(r.prints, fmt.Sprintf(format, args...))
+}
+
+func (r *recordLogger) Errorf(format string, args ...interface{}) {
+	r.prints = append(r.prints, fmt.Sprintf(format, args...))
+}
@@ -59,11 +59,19 @@ func (l Level) ErrorEnabled() bool {
 
 // ParseLevel parses the log level, returns Info level if not found
 func ParseLevel(lvl string) Level {
+	if l, ok := parseLevel(lvl); ok {
+		return l
+	}
+	return Info
+}
+
+// parseLevel parses the log level, returns false if not found
+func parseLevel(lvl string) (Level, bool) {
 	lvl = strings.ToUpper(lvl)
 	for i, l := range stringLevels {
 		if l == lvl {
-			return levels[i]
+			return levels[i], true
 		}
 	}
-	return Info
+	return Info, false
 }
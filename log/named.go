@@ -0,0 +1,92 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// namedLevels holds the Levels set by SetLevelFor, name -> Level
+var namedLevels sync.Map
+
+// Named returns a StructuredLogger for the subsystem name that writes to the
+// global Log. The subsystems of this library are named auth, jwt, key,
+// product, quota, analytics and cache. If a Level is set for name with
+// SetLevelFor, it is used instead of the Level of Log.
+func Named(name string) StructuredLogger {
+	return &fieldsLogger{name: name}
+}
+
+// SetLevelFor sets the Level of Named loggers for name. A Level more verbose
+// than that of Log is only honored if Log is the default logger or a
+// LevelWrapper.
+func SetLevelFor(name string, level Level) {
+	namedLevels.Store(name, level)
+}
+
+// ResetLevelFor removes the Level set for name, Named loggers for name
+// will use the Level of Log.
+func ResetLevelFor(name string) {
+	namedLevels.Delete(name)
+}
+
+// LevelFor returns the Level set for name, if any
+func LevelFor(name string) (Level, bool) {
+	if lvl, ok := namedLevels.Load(name); ok {
+		return lvl.(Level), true
+	}
+	return 0, false
+}
+
+// SetLevels sets the Levels of Named loggers from a comma-separated list of
+// name=level pairs, such as "auth=debug,analytics=warn".
+func SetLevels(spec string) error {
+	levels := map[string]Level{}
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid level %q, must be name=level", pair)
+		}
+		lvl, ok := parseLevel(strings.TrimSpace(kv[1]))
+		if !ok {
+			return fmt.Errorf("invalid level %q for %s", kv[1], kv[0])
+		}
+		levels[strings.TrimSpace(kv[0])] = lvl
+	}
+	for name, lvl := range levels {
+		SetLevelFor(name, lvl)
+	}
+	return nil
+}
+
+// unleveledDefault writes at all levels
+var unleveledDefault = &defaultLogger{level: Debug}
+
+// unleveled returns a Logger that writes to l regardless of the Level of l,
+// if l is known, otherwise l
+func unleveled(l LoggerWithLevel) Logger {
+	switch l := l.(type) {
+	case *defaultLogger:
+		return unleveledDefault
+	case *LevelWrapper:
+		return l.Logger
+	}
+	return l
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNamed(t *testing.T) {
+	defer func(l LoggerWithLevel) { Log = l }(Log)
+	defer ResetLevelFor("auth")
+	defer ResetLevelFor("analytics")
+
+	rl := &recordLogger{}
+	Log = &LevelWrapper{rl, Info}
+	auth := Named("auth").WithFields(Fields{"org": "o"})
+	analytics := Named("analytics")
+
+	if err := SetLevels("auth=debug, analytics=WARN"); err != nil {
+		t.Fatal(err)
+	}
+	if !auth.DebugEnabled() || analytics.InfoEnabled() {
+		t.Errorf("want auth debug and analytics warn, got %s and %s", auth.Level(), analytics.Level())
+	}
+	auth.Debugf("auth debug")
+	analytics.Infof("analytics info")
+	analytics.Warnf("analytics warn")
+	Debugf("global debug")
+
+	ResetLevelFor("auth")
+	auth.Debugf("auth debug after reset")
+	if auth.Level() != Info {
+		t.Errorf("want %s, got %s", Info, auth.Level())
+	}
+
+	analytics.SetLevel(Error)
+	if lvl, ok := LevelFor("analytics"); !ok || lvl != Error {
+		t.Errorf("want %s, got %s", Error, lvl)
+	}
+
+	want := []string{"auth debug org=o", "analytics warn"}
+	if fmt.Sprint(rl.prints) != fmt.Sprint(want) {
+		t.Errorf("want %q, got %q", want, rl.prints)
+	}
+}
+
+func TestSetLevelsInvalid(t *testing.T) {
+	for _, spec := range []string{"auth", "=debug", "auth=verbose"} {
+		if err := SetLevels(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+	if _, ok := LevelFor("auth"); ok {
+		t.Errorf("no levels should be set")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimited returns a StructuredLogger that writes messages with the same
+// level and format to l at most once per interval. The number of messages
+// suppressed since the last one written is added as the "suppressed" field.
+// Loggers returned by WithFields share the limit.
+func RateLimited(l StructuredLogger, interval time.Duration) StructuredLogger {
+	return &rateLimitedLogger{
+		StructuredLogger: l,
+		limiter: &rateLimiter{
+			interval: interval,
+			now:      time.Now,
+			formats:  map[rateKey]*rateState{},
+		},
+	}
+}
+
+type rateLimitedLogger struct {
+	StructuredLogger
+	limiter *rateLimiter
+}
+
+type rateKey struct {
+	level  Level
+	format string
+}
+
+type rateState struct {
+	last       time.Time
+	suppressed int
+}
+
+type rateLimiter struct {
+	interval time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	formats  map[rateKey]*rateState
+}
+
+// allow returns whether a message may be written and the number of
+// messages suppressed since the last one
+func (r *rateLimiter) allow(lvl Level, format string) (bool, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	key := rateKey{lvl, format}
+	state, ok := r.formats[key]
+	if !ok {
+		r.formats[key] = &rateState{last: now}
+		return true, 0
+	}
+	if now.Sub(state.last) < r.interval {
+		state.suppressed++
+		return false, 0
+	}
+	suppressed := state.suppressed
+	state.last = now
+	state.suppressed = 0
+	return true, suppressed
+}
+
+// limit returns the logger to write a message to, or nil if suppressed
+func (r *rateLimitedLogger) limit(lvl Level, format string) Logger {
+	if r.Level() < lvl {
+		return nil
+	}
+	ok, suppressed := r.limiter.allow(lvl, format)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		return r.StructuredLogger.WithFields(Fields{"suppressed": suppressed})
+	}
+	return r.StructuredLogger
+}
+
+func (r *rateLimitedLogger) WithFields(fields Fields) StructuredLogger {
+	return &rateLimitedLogger{
+		StructuredLogger: r.StructuredLogger.WithFields(fields),
+		limiter:          r.limiter,
+	}
+}
+
+func (r *rateLimitedLogger) Debugf(format string, args ...interface{}) {
+	if l := r.limit(Debug, format); l != nil {
+		l.Debugf(format, args...)
+	}
+}
+
+func (r *rateLimitedLogger) Infof(format string, args ...interface{}) {
+	if l := r.limit(Info, format); l != nil {
+		l.Infof(format, args...)
+	}
+}
+
+func (r *rateLimitedLogger) Warnf(format string, args ...interface{}) {
+	if l := r.limit(Warn, format); l != nil {
+		l.Warnf(format, args...)
+	}
+}
+
+func (r *rateLimitedLogger) Errorf(format string, args ...interface{}) {
+	if l := r.limit(Error, format); l != nil {
+		l.Errorf(format, args...)
+	}
+}
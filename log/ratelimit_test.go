@@ -0,0 +1,47 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimited(t *testing.T) {
+	rl := &recordLogger{}
+	l := RateLimited(Structured(&LevelWrapper{rl, Info}), time.Minute)
+	now := time.Unix(0, 0)
+	l.(*rateLimitedLogger).limiter.now = func() time.Time { return now }
+
+	fl := l.WithFields(Fields{"org": "o"})
+	for i := 0; i < 3; i++ {
+		fl.Errorf("failed: %d", i)
+		l.Warnf("failed: %d", i)
+		l.Debugf("debug: %d", i)
+	}
+	now = now.Add(time.Minute)
+	l.Errorf("failed: %d", 3)
+	l.Errorf("failed: %d", 4)
+
+	want := []string{
+		"failed: 0 org=o",
+		"failed: 0",
+		"failed: 3 suppressed=2",
+	}
+	if fmt.Sprint(rl.prints) != fmt.Sprint(want) {
+		t.Errorf("want %q, got %q", want, rl.prints)
+	}
+}
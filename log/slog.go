@@ -0,0 +1,105 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// NewSlogLogger returns a StructuredLogger that writes to l with Fields as
+// attributes. Messages are written if enabled by both the Level, initially
+// Debug, and the handler of l.
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	level := &atomic.Int32{}
+	level.Store(int32(Debug))
+	return &slogLogger{
+		logger: l,
+		level:  level,
+	}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+	level  *atomic.Int32 // Level, shared with loggers from WithFields
+}
+
+var slogLevels = [...]slog.Level{slog.LevelError, slog.LevelWarn, slog.LevelInfo, slog.LevelDebug}
+
+func (s *slogLogger) WithFields(fields Fields) StructuredLogger {
+	attrs := make([]interface{}, 0, len(fields))
+	for _, k := range fields.Keys() {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+	return &slogLogger{
+		logger: s.logger.With(attrs...),
+		level:  s.level,
+	}
+}
+
+func (s *slogLogger) enabled(lvl Level) bool {
+	return s.Level() >= lvl && s.logger.Enabled(context.Background(), slogLevels[lvl])
+}
+
+func (s *slogLogger) log(lvl Level, format string, args ...interface{}) {
+	if s.enabled(lvl) {
+		s.logger.Log(context.Background(), slogLevels[lvl], fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *slogLogger) Debugf(format string, args ...interface{}) {
+	s.log(Debug, format, args...)
+}
+
+func (s *slogLogger) Infof(format string, args ...interface{}) {
+	s.log(Info, format, args...)
+}
+
+func (s *slogLogger) Warnf(format string, args ...interface{}) {
+	s.log(Warn, format, args...)
+}
+
+func (s *slogLogger) Errorf(format string, args ...interface{}) {
+	s.log(Error, format, args...)
+}
+
+func (s *slogLogger) Level() Level {
+	return Level(s.level.Load())
+}
+
+func (s *slogLogger) SetLevel(level Level) {
+	s.level.Store(int32(level))
+}
+
+func (s *slogLogger) DebugEnabled() bool {
+	return s.enabled(Debug)
+}
+
+func (s *slogLogger) InfoEnabled() bool {
+	return s.enabled(Info)
+}
+
+func (s *slogLogger) WarnEnabled() bool {
+	return s.enabled(Warn)
+}
+
+func (s *slogLogger) ErrorEnabled() bool {
+	return s.enabled(Error)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	l := NewSlogLogger(slog.New(handler))
+
+	if l.DebugEnabled() {
+		t.Errorf("debug should be disabled by handler")
+	}
+	l.WithFields(Fields{"org": "o", "env": "e"}).Warnf("warn %d", 1)
+	l.Debugf("debug")
+	l.SetLevel(Error)
+	l.Infof("info")
+
+	got := buf.String()
+	if want := `level=WARN msg="warn 1" env=e org=o`; !strings.Contains(got, want) {
+		t.Errorf("want %q in %q", want, got)
+	}
+	if strings.Contains(got, "debug") || strings.Contains(got, "info") {
+		t.Errorf("unexpected message in %q", got)
+	}
+}
+
+func TestSlogLoggerSetLevelConcurrent(t *testing.T) {
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	fl := l.WithFields(Fields{"org": "o"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.SetLevel(levels[i%len(levels)])
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		fl.Infof("info %d", i)
+		_ = fl.Level()
+	}
+	<-done
+	l.SetLevel(Warn)
+	if fl.Level() != Warn {
+		t.Errorf("want level %s shared with WithFields, got %s", Warn, fl.Level())
+	}
+}
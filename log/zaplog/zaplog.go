@@ -0,0 +1,113 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build zaplog
+// +build zaplog
+
+// Package zaplog adapts a zap.Logger to a log.StructuredLogger.
+// It is only built with the zaplog build tag so other programs don't depend
+// on zap.
+package zaplog
+
+import (
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New returns a StructuredLogger that writes to l with Fields as zap fields.
+// Messages are written if enabled by both the Level, initially Debug, and
+// the core of l.
+func New(l *zap.Logger) log.StructuredLogger {
+	return &logger{
+		sugar: l.WithOptions(zap.AddCallerSkip(1)).Sugar(),
+		level: zap.NewAtomicLevelAt(zapLevels[log.Debug]),
+	}
+}
+
+type logger struct {
+	sugar *zap.SugaredLogger
+	level zap.AtomicLevel // shared with loggers from WithFields
+}
+
+var zapLevels = [...]zapcore.Level{zapcore.ErrorLevel, zapcore.WarnLevel, zapcore.InfoLevel, zapcore.DebugLevel}
+
+func (z *logger) WithFields(fields log.Fields) log.StructuredLogger {
+	args := make([]interface{}, 0, len(fields))
+	for _, k := range fields.Keys() {
+		args = append(args, zap.Any(k, fields[k]))
+	}
+	return &logger{
+		sugar: z.sugar.With(args...),
+		level: z.level,
+	}
+}
+
+func (z *logger) enabled(lvl log.Level) bool {
+	return z.level.Enabled(zapLevels[lvl]) && z.sugar.Desugar().Core().Enabled(zapLevels[lvl])
+}
+
+func (z *logger) Debugf(format string, args ...interface{}) {
+	if z.enabled(log.Debug) {
+		z.sugar.Debugf(format, args...)
+	}
+}
+
+func (z *logger) Infof(format string, args ...interface{}) {
+	if z.enabled(log.Info) {
+		z.sugar.Infof(format, args...)
+	}
+}
+
+func (z *logger) Warnf(format string, args ...interface{}) {
+	if z.enabled(log.Warn) {
+		z.sugar.Warnf(format, args...)
+	}
+}
+
+func (z *logger) Errorf(format string, args ...interface{}) {
+	if z.enabled(log.Error) {
+		z.sugar.Errorf(format, args...)
+	}
+}
+
+func (z *logger) Level() log.Level {
+	lvl := z.level.Level()
+	for l, zl := range zapLevels {
+		if zl == lvl {
+			return log.Level(l)
+		}
+	}
+	return log.Debug
+}
+
+func (z *logger) SetLevel(level log.Level) {
+	z.level.SetLevel(zapLevels[level])
+}
+
+func (z *logger) DebugEnabled() bool {
+	return z.enabled(log.Debug)
+}
+
+func (z *logger) InfoEnabled() bool {
+	return z.enabled(log.Info)
+}
+
+func (z *logger) WarnEnabled() bool {
+	return z.enabled(log.Warn)
+}
+
+func (z *logger) ErrorEnabled() bool {
+	return z.enabled(log.Error)
+}
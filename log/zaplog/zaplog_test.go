@@ -0,0 +1,78 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build zaplog
+// +build zaplog
+
+package zaplog
+
+import (
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := New(zap.New(core))
+
+	if l.DebugEnabled() {
+		t.Errorf("debug should be disabled by core")
+	}
+	fl := l.WithFields(log.Fields{"org": "o", "quota": "q"})
+	fl.Warnf("warn %d", 1)
+	l.Debugf("debug")
+	l.SetLevel(log.Error)
+	fl.Infof("info")
+
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("want 1 entry, got %d: %v", len(entries), entries)
+	}
+	e := entries[0]
+	if e.Level != zapcore.WarnLevel || e.Message != "warn 1" {
+		t.Errorf("unexpected entry: %v", e)
+	}
+	fields := e.ContextMap()
+	if fields["org"] != "o" || fields["quota"] != "q" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestLoggerSetLevelConcurrent(t *testing.T) {
+	l := New(zap.NewNop())
+	fl := l.WithFields(log.Fields{"org": "o"})
+	levels := []log.Level{log.Error, log.Warn, log.Info, log.Debug}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.SetLevel(levels[i%len(levels)])
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		fl.Infof("info %d", i)
+		_ = fl.Level()
+	}
+	<-done
+	for _, lvl := range levels {
+		l.SetLevel(lvl)
+		if fl.Level() != lvl {
+			t.Errorf("want level %s shared with WithFields, got %s", lvl, fl.Level())
+		}
+	}
+}
@@ -26,10 +26,11 @@ import (
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const productsURL = "/products"
@@ -47,10 +48,15 @@ Usage:
 type Manager interface {
 	Products() ProductsNameMap
 	Authorize(authContext *auth.Context, api, path, method string) []AuthorizedOperation
+	Health() health.Status
 	Close()
 }
 
 func createManager(options Options) *manager {
+	logger := options.Logger
+	if logger == nil {
+		logger = log.Named("product")
+	}
 	return &manager{
 		baseURL:          options.BaseURL,
 		closedChan:       make(chan bool),
@@ -60,6 +66,10 @@ func createManager(options Options) *manager {
 		client:           options.Client,
 		env:              options.Env, // note: "*" means multitenant
 		prometheusLabels: prometheus.Labels{"org": options.Org},
+		tracerProvider:   options.TracerProvider,
+		metrics:          newMetrics(options.Metrics),
+		health:           &health.Tracker{Name: "products", RequireSuccess: true},
+		logger:           logger.WithFields(log.Fields{"org": options.Org, "env": options.Env}),
 	}
 }
 
@@ -74,6 +84,10 @@ type manager struct {
 	cancelPolling    context.CancelFunc
 	prometheusLabels prometheus.Labels
 	env              string
+	tracerProvider   trace.TracerProvider
+	metrics          *metrics
+	health           *health.Tracker
+	logger           log.StructuredLogger
 }
 
 // AuthorizedOperation is the result of Authorize including Quotas
@@ -87,9 +101,9 @@ type AuthorizedOperation struct {
 
 // Authorize a request against API Products and its Operations
 func (m *manager) Authorize(authContext *auth.Context, api, path, method string) []AuthorizedOperation {
-	authorizedOps, hints := authorize(authContext, m.Products(), api, path, method, log.DebugEnabled())
-	if log.DebugEnabled() {
-		log.Debugf(hints)
+	authorizedOps, hints := authorize(authContext, m.Products(), api, path, method, m.logger.DebugEnabled())
+	if m.logger.DebugEnabled() {
+		m.logger.Debugf(hints)
 	}
 	return authorizedOps
 }
@@ -136,19 +150,25 @@ func (m *manager) Products() ProductsNameMap {
 	return m.productsMux.Get()
 }
 
+// Health is Ready once products have been retrieved and Degraded if the
+// most recent retrieval failed.
+func (m *manager) Health() health.Status {
+	return m.health.Status()
+}
+
 // Close shuts down the manager.
 func (m *manager) Close() {
 	if m == nil || m.closed.SetTrue() {
 		return
 	}
-	log.Infof("closing product manager")
+	m.logger.Infof("closing product manager")
 	m.cancelPolling()
 	m.productsMux.Close()
-	log.Infof("closed product manager")
+	m.logger.Infof("closed product manager")
 }
 
 func (m *manager) start() {
-	log.Infof("starting product manager")
+	m.logger.Infof("starting product manager")
 	m.productsMux = productsMux{
 		setChan:   make(chan ProductsNameMap),
 		getChan:   make(chan ProductsNameMap),
@@ -168,31 +188,44 @@ func (m *manager) start() {
 	ctx, cancel := context.WithCancel(context.Background())
 	m.cancelPolling = cancel
 	poller.Start(ctx, m.pollingClosure(apiURL), m.refreshRate, func(err error) error {
-		log.Errorf("Error retrieving products: %v", err)
+		m.logger.Errorf("Error retrieving products: %v", err)
 		return nil
 	})
 
-	log.Infof("started product manager")
+	m.logger.Infof("started product manager")
 }
 
 func (m *manager) pollingClosure(apiURL url.URL) func(ctx context.Context) error {
 	var etag string
-	return func(ctx context.Context) error {
+	return func(ctx context.Context) (err error) {
+		env := m.env
+		if env == "*" {
+			env = ""
+		}
+		ctx, span := util.Tracer(m.tracerProvider, "product").Start(ctx, "apigee.product.poll",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(util.OrgEnv(m.prometheusLabels["org"], env)...))
+		defer func() { util.EndSpan(span, err) }()
+		defer func() {
+			if ctx.Err() == nil {
+				m.health.Record(err)
+			}
+		}()
 
-		req, err := http.NewRequest(http.MethodGet, apiURL.String(), nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil) // cancelable from poller
 		if err != nil {
 			return err
 		}
-		req = req.WithContext(ctx) // make cancelable from poller
 
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "application/json")
+		util.InjectTraceContext(ctx, req)
 
 		if etag != "" {
 			req.Header.Set("If-None-Match", etag)
 		}
 
-		log.Debugf("retrieving products from: %s", apiURL.String())
+		m.logger.Debugf("retrieving products from: %s", apiURL.String())
 
 		resp, err := m.client.Do(req)
 		if err != nil {
@@ -202,30 +235,30 @@ func (m *manager) pollingClosure(apiURL url.URL) func(ctx context.Context) error
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Errorf("Unable to read server response: %v", err)
+			m.logger.Errorf("Unable to read server response: %v", err)
 			return err
 		}
 
 		if resp.StatusCode == 304 {
-			log.Debugf("products not modified")
+			m.logger.Debugf("products not modified")
 			return nil
 		}
 
 		if resp.StatusCode != 200 {
 			err := fmt.Errorf("products request failed (%d): %s", resp.StatusCode, string(body))
-			log.Errorf(err.Error())
+			m.logger.Errorf(err.Error())
 			return err
 		}
 
 		etag = resp.Header.Get("ETag")
 		if etag != "" {
-			log.Debugf("received etag for products request: '%s'", etag)
+			m.logger.Debugf("received etag for products request: '%s'", etag)
 		}
 
 		var res APIResponse
 		err = json.Unmarshal(body, &res)
 		if err != nil {
-			log.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
+			m.logger.Errorf("unable to unmarshal JSON response '%s': %v", string(body), err)
 			return err
 		}
 
@@ -233,16 +266,16 @@ func (m *manager) pollingClosure(apiURL url.URL) func(ctx context.Context) error
 		pm := ProductsNameMap{}
 		for i, p := range res.APIProducts {
 			if ctx.Err() != nil {
-				log.Debugf("product polling canceled, exiting")
+				m.logger.Debugf("product polling canceled, exiting")
 				return nil
 			}
 			pm[p.Name] = &res.APIProducts[i]
 		}
 		m.productsMux.Set(pm)
 
-		prometheusProductsRecords.With(m.prometheusLabels).Set(float64(len(pm)))
+		m.metrics.productsRecords.With(m.prometheusLabels).Set(float64(len(pm)))
 
-		log.Debugf("retrieved %d products, kept %d", len(res.APIProducts), len(pm))
+		m.logger.Debugf("retrieved %d products, kept %d", len(res.APIProducts), len(pm))
 
 		return nil
 	}
@@ -298,10 +331,17 @@ func (p productsMux) mux() {
 	}
 }
 
-var (
-	prometheusProductsRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "products",
-		Name:      "cached",
-		Help:      "Number of products cached in memory",
-	}, []string{"org"})
-)
+// metrics are the products Prometheus metrics
+type metrics struct {
+	productsRecords *prometheus.GaugeVec
+}
+
+func newMetrics(opts util.MetricsOptions) *metrics {
+	return &metrics{
+		productsRecords: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "products",
+			Name:      "cached",
+			Help:      "Number of products cached in memory",
+		}, []string{"org"}),
+	}
+}
@@ -26,6 +26,13 @@ import (
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestManager(t *testing.T) {
@@ -215,6 +222,158 @@ func TestManagerPolling(t *testing.T) {
 	pp.Close()
 }
 
+func TestManagerTracing(t *testing.T) {
+	prop := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(prop)
+
+	traceparents := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(APIResponse{})
+	}))
+	defer ts.Close()
+
+	serverURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	opts := Options{
+		BaseURL:        serverURL,
+		RefreshRate:    time.Minute,
+		Client:         http.DefaultClient,
+		Org:            "org",
+		Env:            "env",
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	}
+	pp := createManager(opts)
+	pp.start()
+	defer pp.Close()
+
+	traceparent := <-traceparents
+	var spans []sdktrace.ReadOnlySpan
+	for i := 0; i < 100 && len(spans) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		spans = recorder.Ended()
+	}
+	if len(spans) != 1 {
+		t.Fatalf("want 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "apigee.product.poll" {
+		t.Errorf("want span apigee.product.poll, got %s", span.Name())
+	}
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs["apigee.org"] != "org" || attrs["apigee.env"] != "env" {
+		t.Errorf("want org and env attributes, got %v", attrs)
+	}
+	if !strings.Contains(traceparent, span.SpanContext().TraceID().String()) {
+		t.Errorf("want traceparent with trace %s, got %q", span.SpanContext().TraceID(), traceparent)
+	}
+}
+
+func TestManagerMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(APIResponse{
+			APIProducts: []APIProduct{{Name: "Name 1"}, {Name: "Name 2"}},
+		})
+	}))
+	defer ts.Close()
+
+	serverURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	opts := Options{
+		BaseURL:     serverURL,
+		RefreshRate: time.Minute,
+		Client:      http.DefaultClient,
+		Org:         "org",
+		Env:         "env",
+		Metrics: util.MetricsOptions{
+			Registerer:  reg,
+			Namespace:   "apigee",
+			ConstLabels: prometheus.Labels{"instance": "test"},
+		},
+	}
+	pp := createManager(opts)
+	pp.start()
+	defer pp.Close()
+
+	if len(pp.Products()) != 2 {
+		t.Fatalf("want 2 products, got %d", len(pp.Products()))
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "apigee_products_cached" {
+		t.Fatalf("want only apigee_products_cached, got %v", families)
+	}
+	if got := families[0].GetMetric()[0].GetGauge().GetValue(); got != 2 {
+		t.Errorf("want 2 products cached, got %v", got)
+	}
+}
+
+func TestManagerHealth(t *testing.T) {
+	fail := make(chan bool, 1)
+	fail <- true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fail:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(APIResponse{})
+		}
+	}))
+	defer ts.Close()
+
+	serverURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		BaseURL:     serverURL,
+		RefreshRate: time.Minute,
+		Client:      http.DefaultClient,
+		Org:         "org",
+		Env:         "env",
+	}
+	pp := createManager(opts)
+	if h := pp.Health(); h.Ready || h.Name != "products" {
+		t.Errorf("want products not ready before start, got %#v", h)
+	}
+	pp.start()
+	defer pp.Close()
+
+	// first poll fails, retry succeeds
+	var h health.Status
+	for i := 0; i < 100; i++ {
+		if h = pp.Health(); h.Ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !h.Ready || h.Degraded {
+		t.Errorf("want ready and not degraded, got %#v", h)
+	}
+	if h.LastError == nil || h.LastErrorTime.After(h.LastSuccess) {
+		t.Errorf("want error before success, got %#v", h)
+	}
+}
+
 func TestManagerHandlingEtag(t *testing.T) {
 	cached := false
 	apiProducts := []APIProduct{
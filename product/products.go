@@ -19,6 +19,10 @@ import (
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TargetsAttr is the name of the Product attribute that lists the targets (apis) it binds to (comma delim)
@@ -46,6 +50,12 @@ type Options struct {
 	Org string
 	// Env is environment, "*" means multi-tenant
 	Env string
+	// TracerProvider, if set, is used to trace requests to Apigee
+	TracerProvider trace.TracerProvider
+	// Metrics determines where products metrics are registered
+	Metrics util.MetricsOptions
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
 }
 
 func (o *Options) validate() error {
@@ -25,8 +25,11 @@ import (
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -45,11 +48,14 @@ type bucket struct {
 	result           *Result
 	created          time.Time
 	lock             sync.RWMutex
-	synced           time.Time     // last sync time
-	checked          time.Time     // last apply time
-	refreshAfter     time.Duration // duration after synced
-	deleteAfter      time.Duration // duration after checked
-	prometheusLabels prometheus.Labels
+	synced           time.Time         // last sync time
+	checked          time.Time         // last apply time
+	refreshAfter     time.Duration     // duration after synced
+	deleteAfter      time.Duration     // duration after checked
+	prometheusLabels prometheus.Labels // org, env, and quota identifier
+	metricLabels     prometheus.Labels // nil if metrics are aggregated
+	product          string
+	logger           log.StructuredLogger
 }
 
 func newBucket(req Request, m *manager, promLabels prometheus.Labels) *bucket {
@@ -66,6 +72,8 @@ func newBucket(req Request, m *manager, promLabels prometheus.Labels) *bucket {
 		deleteAfter:      defaultDeleteAfter,
 		refreshAfter:     defaultRefreshAfter,
 		prometheusLabels: promLabels,
+		metricLabels:     m.bucketMetricLabels(promLabels),
+		logger:           m.logger.WithFields(log.Fields{"env": promLabels["env"], "quota": hashIdentifier(m.metricsHashKey, req.Identifier)}),
 	}
 	b.result = &Result{
 		ExpiryTime: calcLocalExpiry(b.now(), req.Interval, req.TimeUnit).Unix(),
@@ -98,7 +106,9 @@ func (b *bucket) apply(req *Request) (*Result, error) {
 		b.result.Exceeded = 0
 		b.result.ExpiryTime = calcLocalExpiry(b.now(), req.Interval, req.TimeUnit).Unix()
 		b.request.Weight = 0
-		prometheusBucketWindowExpires.With(b.prometheusLabels).Set(float64(b.result.ExpiryTime))
+		if b.metricLabels != nil {
+			b.manager.metrics.bucketWindowExpires.With(b.metricLabels).Set(float64(b.result.ExpiryTime))
+		}
 	}
 
 	if b.result != nil {
@@ -114,8 +124,10 @@ func (b *bucket) apply(req *Request) (*Result, error) {
 		res.Used = res.Allowed
 	}
 
-	prometheusBucketChecked.With(b.prometheusLabels).SetToCurrentTime()
-	prometheusBucketValue.With(b.prometheusLabels).Set(float64(res.Used))
+	if b.metricLabels != nil {
+		b.manager.metrics.bucketChecked.With(b.metricLabels).SetToCurrentTime()
+		b.manager.metrics.bucketValue.With(b.metricLabels).Set(float64(res.Used))
+	}
 
 	return res, nil
 }
@@ -129,9 +141,9 @@ func (b *bucket) compatible(r *Request) bool {
 
 // sync local quota bucket with server
 // single-threaded call - managed by manager
-func (b *bucket) sync() error {
+func (b *bucket) sync() (err error) {
 
-	log.Debugf("syncing quota %s", b.request.Identifier)
+	b.logger.Debugf("syncing quota %s", b.request.Identifier)
 
 	b.lock.Lock()
 	r := *b.request // make copy
@@ -151,10 +163,18 @@ func (b *bucket) sync() error {
 		return errors.Wrap(err, "new request")
 	}
 
+	ctx, span := util.Tracer(b.manager.tracerProvider, "quota").Start(req.Context(), "apigee.quota.sync",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(util.OrgEnv(b.prometheusLabels["org"], b.prometheusLabels["env"])...),
+		trace.WithAttributes(attribute.String("apigee.quota_hash", hashIdentifier(b.manager.metricsHashKey, r.Identifier))))
+	defer func() { util.EndSpan(span, err) }()
+	req = req.WithContext(ctx)
+
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	util.InjectTraceContext(ctx, req)
 
-	log.Debugf("sending quota: %s", body)
+	b.logger.Debugf("sending quota: %s", body)
 
 	resp, err := b.manager.client.Do(req)
 	if err != nil {
@@ -187,10 +207,12 @@ func (b *bucket) sync() error {
 			b.request.Weight -= r.Weight // same window, keep accumulated Weight
 		}
 		b.result = &quotaResult
-		log.Debugf("quota synced: %#v", quotaResult)
+		b.logger.Debugf("quota synced: %#v", quotaResult)
 		b.lock.Unlock()
 
-		prometheusBucketSynced.With(b.prometheusLabels).SetToCurrentTime()
+		if b.metricLabels != nil {
+			b.manager.metrics.bucketSynced.With(b.metricLabels).SetToCurrentTime()
+		}
 
 		return nil
 
@@ -20,12 +20,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestBucket(t *testing.T) {
 	now := func() time.Time { return time.Unix(1521221450, 0) }
-	m := &manager{now: now}
+	m := &manager{now: now, metrics: newMetrics(util.MetricsOptions{}), logger: log.Structured(nil)}
 
 	cases := map[string]struct {
 		priorRequest *Request
@@ -141,7 +143,7 @@ func TestBucket(t *testing.T) {
 
 func TestNeedToDelete(t *testing.T) {
 	now := func() time.Time { return time.Unix(1521221450, 0) }
-	m := &manager{now: now}
+	m := &manager{now: now, metrics: newMetrics(util.MetricsOptions{}), logger: log.Structured(nil)}
 
 	cases := map[string]struct {
 		request *Request
@@ -211,7 +213,7 @@ func TestNeedToDelete(t *testing.T) {
 
 func TestNeedToSync(t *testing.T) {
 	now := func() time.Time { return time.Unix(1521221450, 0) }
-	m := &manager{now: now}
+	m := &manager{now: now, metrics: newMetrics(util.MetricsOptions{}), logger: log.Structured(nil)}
 
 	cases := map[string]struct {
 		request *Request
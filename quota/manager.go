@@ -23,11 +23,12 @@ import (
 	"time"
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
 	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/product"
 	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -54,6 +55,7 @@ Dispatch basically works like this:
 type Manager interface {
 	Start()
 	Apply(authContext *auth.Context, o product.AuthorizedOperation, args Args) (*Result, error)
+	Health() health.Status
 	Close()
 }
 
@@ -74,6 +76,14 @@ type manager struct {
 	org                string
 	runningContext     context.Context
 	cancelContext      context.CancelFunc
+	tracerProvider     trace.TracerProvider
+	metrics            *metrics
+	metricsMode        MetricsMode
+	metricsTopN        int
+	metricsHashKey     []byte
+	reportedMetrics    map[string]prometheus.Labels // aggregated series, by seriesKey
+	health             *health.Tracker
+	logger             log.StructuredLogger
 }
 
 // NewManager constructs and starts a new Manager. Call Close when done.
@@ -88,6 +98,14 @@ func NewManager(options Options) (Manager, error) {
 
 // newManager constructs a new Manager
 func newManager(options Options) *manager {
+	topN := options.MetricsTopN
+	if topN == 0 {
+		topN = defaultMetricsTopN
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.Named("quota")
+	}
 	return &manager{
 		close:             make(chan bool),
 		client:            options.Client,
@@ -100,12 +118,20 @@ func newManager(options Options) *manager {
 		dupCache:          ResultCache{size: resultCacheBufferSize},
 		bucketsSyncing:    map[*bucket]struct{}{},
 		org:               options.Org,
+		tracerProvider:    options.TracerProvider,
+		metrics:           newMetrics(options.Metrics),
+		metricsMode:       options.MetricsMode,
+		metricsTopN:       topN,
+		metricsHashKey:    options.MetricsHashKey,
+		reportedMetrics:   map[string]prometheus.Labels{},
+		health:            &health.Tracker{Name: "quota"},
+		logger:            logger.WithFields(log.Fields{"org": options.Org}),
 	}
 }
 
 // Start starts the manager.
 func (m *manager) Start() {
-	log.Infof("starting quota manager")
+	m.logger.Infof("starting quota manager")
 
 	m.runningContext, m.cancelContext = context.WithCancel(context.Background())
 
@@ -114,7 +140,7 @@ func (m *manager) Start() {
 		go m.syncBucketDispatcher()
 	}
 
-	log.Infof("started quota manager with %d workers", m.numSyncWorkers)
+	m.logger.Infof("started quota manager with %d workers", m.numSyncWorkers)
 }
 
 // Close shuts down the manager.
@@ -122,7 +148,7 @@ func (m *manager) Close() {
 	if m == nil {
 		return
 	}
-	log.Infof("closing quota manager")
+	m.logger.Infof("closing quota manager")
 	m.cancelContext()
 	m.runningContext = nil
 
@@ -130,11 +156,27 @@ func (m *manager) Close() {
 	m.close <- true
 	close(m.bucketToSyncQueue)
 	m.syncWorkerWG.Wait()
-	log.Infof("closed quota manager")
+	m.logger.Infof("closed quota manager")
+}
+
+// Health is always Ready as quotas are applied locally. It is Degraded if
+// the most recent sync with Apigee failed.
+func (m *manager) Health() health.Status {
+	return m.health.Status()
 }
 
 // Apply a quota request to the local quota bucket and schedule for sync
 func (m *manager) Apply(authContext *auth.Context, operation product.AuthorizedOperation, args Args) (*Result, error) {
+	return m.ApplyWithContext(context.Background(), authContext, operation, args)
+}
+
+// ApplyWithContext applies a quota request to the local quota bucket and
+// schedules it for sync. Quotas are applied locally, so ctx is only checked
+// before the request is applied.
+func (m *manager) ApplyWithContext(ctx context.Context, authContext *auth.Context, operation product.AuthorizedOperation, args Args) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	if operation.QuotaLimit == 0 {
 		return nil, nil
@@ -162,8 +204,9 @@ func (m *manager) Apply(authContext *auth.Context, operation product.AuthorizedO
 		b, ok = m.buckets[req.Identifier]
 		if !ok || !b.compatible(req) {
 			b = newBucket(*req, m, prometheus.Labels{"org": authContext.Organization(), "env": authContext.Environment(), "quota": req.Identifier})
+			b.product = operation.APIProduct
 			m.buckets[req.Identifier] = b
-			log.Debugf("new quota bucket: %s", req.Identifier)
+			m.logger.Debugf("new quota bucket: %s", req.Identifier)
 		}
 		m.bucketsLock.Unlock()
 	}
@@ -202,21 +245,22 @@ func (m *manager) bucketMaintenanceLoop() {
 			m.bucketsLock.RUnlock()
 
 			if deleteIDs != nil {
-				log.Debugf("deleting quota buckets: %v", deleteIDs)
+				m.logger.Debugf("deleting quota buckets: %v", deleteIDs)
 				m.bucketsLock.Lock()
 				for _, id := range deleteIDs {
 					bucket := m.buckets[id]
 					delete(m.buckets, id)
-					prometheusBucketWindowExpires.Delete(bucket.prometheusLabels)
-					prometheusBucketChecked.Delete(bucket.prometheusLabels)
-					prometheusBucketSynced.Delete(bucket.prometheusLabels)
-					prometheusBucketValue.Delete(bucket.prometheusLabels)
+					if bucket.metricLabels != nil {
+						m.deleteMetrics(bucket.metricLabels)
+					}
 				}
 				m.bucketsLock.Unlock()
 			}
 
+			m.reportMetrics()
+
 		case <-m.close:
-			log.Debugf("closing quota sync loop")
+			m.logger.Debugf("closing quota sync loop")
 			t.Stop()
 			return
 		}
@@ -231,16 +275,20 @@ func (m *manager) syncBucketDispatcher() {
 			Backoff: util.NewExponentialBackoff(200*time.Millisecond, 30*time.Second, 2, true),
 		}
 		work := func(ctx context.Context) error {
-			return bucket.sync()
+			err := bucket.sync()
+			if ctx.Err() == nil {
+				m.health.Record(err)
+			}
+			return err
 		}
 		errH := func(err error) error {
-			log.Errorf("sync: %s", err)
+			bucket.logger.Errorf("sync: %s", err)
 			return nil
 		}
 
 		// run until success or canceled with backoff
 		if err := looper.Run(m.runningContext, work, errH); err != nil {
-			log.Errorf("looper run: %s", err)
+			bucket.logger.Errorf("looper run: %s", err)
 		}
 
 		m.bucketsSyncingLock.Lock()
@@ -249,7 +297,7 @@ func (m *manager) syncBucketDispatcher() {
 	}
 
 	m.syncWorkerWG.Done()
-	log.Debugf("closing quota sync worker")
+	m.logger.Debugf("closing quota sync worker")
 }
 
 // Options allows us to specify options for how this auth manager will run
@@ -260,6 +308,21 @@ type Options struct {
 	BaseURL *url.URL
 	// Org is organization
 	Org string
+	// TracerProvider, if set, is used to trace requests to Apigee
+	TracerProvider trace.TracerProvider
+	// Metrics determines where quota metrics are registered
+	Metrics util.MetricsOptions
+	// MetricsMode determines how quota metrics are labeled, the default
+	// MetricsByIdentifier creates a series per developer and app
+	MetricsMode MetricsMode
+	// MetricsTopN is the number of quotas reported by MetricsTopBuckets, default 10
+	MetricsTopN int
+	// MetricsHashKey is a secret that keys the hash of quota identifiers in
+	// metrics so they can't be recovered from guesses. Keep it stable to keep
+	// the series of a quota across restarts.
+	MetricsHashKey []byte
+	// Logger, if set, is used instead of the global log.Log
+	Logger log.StructuredLogger
 }
 
 func (o *Options) validate() error {
@@ -268,31 +331,11 @@ func (o *Options) validate() error {
 		o.Org == "" {
 		return fmt.Errorf("all quota options are required")
 	}
+	if o.MetricsMode < MetricsByIdentifier || o.MetricsMode > MetricsTopBuckets {
+		return fmt.Errorf("invalid quota metrics mode: %d", o.MetricsMode)
+	}
+	if o.MetricsTopN < 0 {
+		return fmt.Errorf("quota metrics top n must be >= 0")
+	}
 	return nil
 }
-
-var (
-	prometheusBucketValue = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "quota",
-		Name:      "value",
-		Help:      "Current value of a quota",
-	}, []string{"org", "env", "quota"})
-
-	prometheusBucketChecked = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "quota",
-		Name:      "checked",
-		Help:      "Time quota was last checked",
-	}, []string{"org", "env", "quota"})
-
-	prometheusBucketSynced = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "quota",
-		Name:      "synced",
-		Help:      "Time quota was last synced",
-	}, []string{"org", "env", "quota"})
-
-	prometheusBucketWindowExpires = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Subsystem: "quota",
-		Name:      "window_expires",
-		Help:      "Time quota window will expire",
-	}, []string{"org", "env", "quota"})
-)
@@ -15,6 +15,7 @@
 package quota
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -25,8 +26,13 @@ import (
 
 	"github.com/apigee/apigee-remote-service-golib/v2/auth"
 	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/health"
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
 	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
 	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestQuota(t *testing.T) {
@@ -138,6 +144,50 @@ func TestQuota(t *testing.T) {
 }
 
 // not fully determinate, uses delays and background threads
+func TestApplyWithContext(t *testing.T) {
+	authContext := &auth.Context{Context: authtest.NewContext("http://localhost")}
+	api := product.AuthorizedOperation{
+		ID:            "id",
+		QuotaLimit:    1,
+		QuotaInterval: 1,
+		QuotaTimeUnit: quotaMinute,
+	}
+	m := newManager(Options{
+		Client:  http.DefaultClient,
+		BaseURL: authContext.InternalAPI(),
+		Org:     "org",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.ApplyWithContext(ctx, authContext, api, Args{QuotaAmount: 1}); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if len(m.buckets) != 0 {
+		t.Errorf("want no buckets, got %d", len(m.buckets))
+	}
+
+	res, err := m.ApplyWithContext(context.Background(), authContext, api, Args{QuotaAmount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Used != 1 {
+		t.Errorf("want used 1, got %d", res.Used)
+	}
+
+	// a Manager without ApplyWithContext is called unless ctx is done
+	applyOnly := struct{ Manager }{m}
+	if _, err := ApplyWithContext(ctx, applyOnly, authContext, api, Args{QuotaAmount: 1}); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if res, err = ApplyWithContext(context.Background(), applyOnly, authContext, api, Args{QuotaAmount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Exceeded != 1 {
+		t.Errorf("want exceeded 1, got %d", res.Exceeded)
+	}
+}
+
 func TestSync(t *testing.T) {
 
 	fakeTime := newClock()
@@ -168,6 +218,9 @@ func TestSync(t *testing.T) {
 		baseURL:           context.InternalAPI(),
 		numSyncWorkers:    1,
 		bucketsSyncing:    map[*bucket]struct{}{},
+		metrics:           newMetrics(util.MetricsOptions{}),
+		health:            &health.Tracker{},
+		logger:            log.Structured(nil),
 	}
 
 	b := newBucket(*request, m, prometheus.Labels{"org": "org", "env": "env", "quota": quotaID})
@@ -251,6 +304,52 @@ func TestSync(t *testing.T) {
 	}
 }
 
+func TestSyncSpan(t *testing.T) {
+	fakeTime := newClock()
+	serverResult := Result{}
+	ts, _ := testServer(&serverResult, fakeTime.now, nil)
+	defer ts.Close()
+
+	ctx := authtest.NewContext(ts.URL)
+	recorder := tracetest.NewSpanRecorder()
+	key := []byte("secret")
+	m := &manager{
+		client:         http.DefaultClient,
+		now:            fakeTime.now,
+		baseURL:        ctx.InternalAPI(),
+		runningContext: context.Background(),
+		tracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+		metrics:        newMetrics(util.MetricsOptions{}),
+		metricsHashKey: key,
+		health:         &health.Tracker{},
+		logger:         log.Structured(nil),
+	}
+
+	const quotaID = "p1-env-dev1@example.com-app1"
+	request := Request{Identifier: quotaID, Interval: 1, TimeUnit: quotaSecond, Allow: 1, Weight: 1}
+	b := newBucket(request, m, prometheus.Labels{"org": "org", "env": "env", "quota": quotaID})
+	if err := b.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("want 1 span, got %d", len(spans))
+	}
+	attrs := map[string]string{}
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs["apigee.quota_hash"] != hashIdentifier(key, quotaID) {
+		t.Errorf("want hashed quota attribute, got %v", attrs)
+	}
+	for k, v := range attrs {
+		if v == quotaID {
+			t.Errorf("quota identifier must not be in attribute %s", k)
+		}
+	}
+}
+
 func TestDisconnected(t *testing.T) {
 	fakeTime := newClock()
 
@@ -281,6 +380,9 @@ func TestDisconnected(t *testing.T) {
 		numSyncWorkers:    1,
 		buckets:           map[string]*bucket{},
 		bucketsSyncing:    map[*bucket]struct{}{},
+		metrics:           newMetrics(util.MetricsOptions{}),
+		health:            &health.Tracker{},
+		logger:            log.Structured(nil),
 	}
 
 	api := product.AuthorizedOperation{
@@ -378,6 +480,9 @@ func TestWindowExpired(t *testing.T) {
 		numSyncWorkers:    1,
 		buckets:           map[string]*bucket{},
 		bucketsSyncing:    map[*bucket]struct{}{},
+		metrics:           newMetrics(util.MetricsOptions{}),
+		health:            &health.Tracker{},
+		logger:            log.Structured(nil),
 	}
 
 	api := product.AuthorizedOperation{
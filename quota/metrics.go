@@ -0,0 +1,256 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultMetricsTopN = 10
+
+// MetricsMode determines the "quota" label of quota metrics.
+// A quota identifier includes the developer and app of the quota, so modes
+// other than MetricsByIdentifier avoid a series per developer and app.
+type MetricsMode int
+
+const (
+	// MetricsByIdentifier labels metrics with the quota identifier.
+	MetricsByIdentifier MetricsMode = iota
+	// MetricsByProduct labels metrics with the API product and aggregates
+	// all quotas of the product: values are summed, times are the latest.
+	MetricsByProduct
+	// MetricsByHash labels metrics with a hash of the quota identifier.
+	// Set Options.MetricsHashKey, as without it, identifiers can be found by
+	// hashing guesses such as known developer emails.
+	MetricsByHash
+	// MetricsTopBuckets reports only the MetricsTopN quotas with the highest
+	// values, labeled with a hash of the quota identifier.
+	MetricsTopBuckets
+)
+
+// String returns the name of the mode
+func (m MetricsMode) String() string {
+	switch m {
+	case MetricsByIdentifier:
+		return "identifier"
+	case MetricsByProduct:
+		return "product"
+	case MetricsByHash:
+		return "hash"
+	case MetricsTopBuckets:
+		return "top"
+	}
+	return "unknown"
+}
+
+// aggregated is true if metrics are reported by the maintenance loop
+// rather than as each bucket changes
+func (m MetricsMode) aggregated() bool {
+	return m == MetricsByProduct || m == MetricsTopBuckets
+}
+
+// metrics are the quota Prometheus metrics
+type metrics struct {
+	bucketValue         *prometheus.GaugeVec
+	bucketChecked       *prometheus.GaugeVec
+	bucketSynced        *prometheus.GaugeVec
+	bucketWindowExpires *prometheus.GaugeVec
+}
+
+func newMetrics(opts util.MetricsOptions) *metrics {
+	return &metrics{
+		bucketValue: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "value",
+			Help:      "Current value of a quota",
+		}, []string{"org", "env", "quota"}),
+
+		bucketChecked: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "checked",
+			Help:      "Time quota was last checked",
+		}, []string{"org", "env", "quota"}),
+
+		bucketSynced: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "synced",
+			Help:      "Time quota was last synced",
+		}, []string{"org", "env", "quota"}),
+
+		bucketWindowExpires: opts.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "window_expires",
+			Help:      "Time quota window will expire",
+		}, []string{"org", "env", "quota"}),
+	}
+}
+
+// hashIdentifier returns a short, stable hash of a quota identifier, an
+// HMAC-SHA256 if key is set. Without a key, the hash is not anonymization.
+func hashIdentifier(key []byte, id string) string {
+	var sum []byte
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(id))
+		sum = mac.Sum(nil)
+	} else {
+		hash := sha256.Sum256([]byte(id))
+		sum = hash[:]
+	}
+	return hex.EncodeToString(sum[:8])
+}
+
+// bucketMetricLabels returns the labels a bucket reports itself with,
+// nil if its metrics are aggregated
+func (m *manager) bucketMetricLabels(labels prometheus.Labels) prometheus.Labels {
+	switch m.metricsMode {
+	case MetricsByIdentifier:
+		return labels
+	case MetricsByHash:
+		return prometheus.Labels{"org": labels["org"], "env": labels["env"], "quota": hashIdentifier(m.metricsHashKey, labels["quota"])}
+	}
+	return nil
+}
+
+// metricsSample is a snapshot of bucket state for metrics
+type metricsSample struct {
+	labels  prometheus.Labels
+	value   float64
+	checked time.Time
+	synced  time.Time
+	expires time.Time
+}
+
+// sample returns the current bucket state labeled by identity
+func (b *bucket) sample() metricsSample {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	used := b.request.Weight
+	if b.result != nil && !b.windowExpired() {
+		used += b.result.Used + b.result.Exceeded
+	}
+	if used > b.request.Allow {
+		used = b.request.Allow
+	}
+	s := metricsSample{
+		labels:  b.prometheusLabels,
+		value:   float64(used),
+		checked: b.checked,
+		synced:  b.synced,
+	}
+	if b.result != nil {
+		s.expires = time.Unix(b.result.ExpiryTime, 0)
+	}
+	return s
+}
+
+// reportMetrics sets aggregated metrics from current buckets and deletes
+// series no longer reported. Only called from the maintenance loop.
+func (m *manager) reportMetrics() {
+	if !m.metricsMode.aggregated() {
+		return
+	}
+
+	m.bucketsLock.RLock()
+	samples := make([]metricsSample, 0, len(m.buckets))
+	products := make([]string, 0, len(m.buckets))
+	for _, b := range m.buckets {
+		samples = append(samples, b.sample())
+		products = append(products, b.product)
+	}
+	m.bucketsLock.RUnlock()
+
+	series := map[string]*metricsSample{}
+	switch m.metricsMode {
+	case MetricsByProduct:
+		for i, s := range samples {
+			labels := prometheus.Labels{"org": s.labels["org"], "env": s.labels["env"], "quota": products[i]}
+			key := seriesKey(labels)
+			agg, ok := series[key]
+			if !ok {
+				series[key] = &metricsSample{labels: labels, value: s.value, checked: s.checked, synced: s.synced, expires: s.expires}
+				continue
+			}
+			agg.value += s.value
+			agg.checked = latest(agg.checked, s.checked)
+			agg.synced = latest(agg.synced, s.synced)
+			agg.expires = latest(agg.expires, s.expires)
+		}
+
+	case MetricsTopBuckets:
+		sort.Slice(samples, func(i, j int) bool {
+			if samples[i].value != samples[j].value {
+				return samples[i].value > samples[j].value
+			}
+			return samples[i].labels["quota"] < samples[j].labels["quota"]
+		})
+		if len(samples) > m.metricsTopN {
+			samples = samples[:m.metricsTopN]
+		}
+		for i := range samples {
+			s := &samples[i]
+			s.labels = prometheus.Labels{"org": s.labels["org"], "env": s.labels["env"], "quota": hashIdentifier(m.metricsHashKey, s.labels["quota"])}
+			series[seriesKey(s.labels)] = s
+		}
+	}
+
+	for key, labels := range m.reportedMetrics {
+		if _, ok := series[key]; !ok {
+			m.deleteMetrics(labels)
+			delete(m.reportedMetrics, key)
+		}
+	}
+	for key, s := range series {
+		m.metrics.bucketValue.With(s.labels).Set(s.value)
+		m.metrics.bucketChecked.With(s.labels).Set(unixSeconds(s.checked))
+		if !s.synced.IsZero() {
+			m.metrics.bucketSynced.With(s.labels).Set(unixSeconds(s.synced))
+		}
+		if !s.expires.IsZero() {
+			m.metrics.bucketWindowExpires.With(s.labels).Set(unixSeconds(s.expires))
+		}
+		m.reportedMetrics[key] = s.labels
+	}
+}
+
+// deleteMetrics deletes all quota series with labels
+func (m *manager) deleteMetrics(labels prometheus.Labels) {
+	m.metrics.bucketWindowExpires.Delete(labels)
+	m.metrics.bucketChecked.Delete(labels)
+	m.metrics.bucketSynced.Delete(labels)
+	m.metrics.bucketValue.Delete(labels)
+}
+
+func seriesKey(labels prometheus.Labels) string {
+	return labels["org"] + "\x00" + labels["env"] + "\x00" + labels["quota"]
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
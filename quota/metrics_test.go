@@ -0,0 +1,150 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/authtest"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+	"github.com/apigee/apigee-remote-service-golib/v2/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHashIdentifier(t *testing.T) {
+	const id = "p1-env-dev1@example.com-app1"
+	unkeyed := hashIdentifier(nil, id)
+	keyed := hashIdentifier([]byte("secret"), id)
+	if len(unkeyed) != 16 || len(keyed) != 16 {
+		t.Errorf("want 16 hex digits, got %s and %s", unkeyed, keyed)
+	}
+	if keyed == unkeyed || keyed == hashIdentifier([]byte("other"), id) {
+		t.Errorf("want hash to depend on key")
+	}
+	if keyed != hashIdentifier([]byte("secret"), id) {
+		t.Errorf("want stable hash")
+	}
+}
+
+func TestMetricsModes(t *testing.T) {
+	const (
+		id1 = "p1-env-dev1@example.com-app1"
+		id2 = "p1-env-dev2@example.com-app2"
+		id3 = "p2-env-dev3@example.com-app3"
+	)
+	ops := []struct {
+		op     product.AuthorizedOperation
+		weight int64
+	}{
+		{product.AuthorizedOperation{ID: id1, APIProduct: "p1", QuotaLimit: 10, QuotaInterval: 1, QuotaTimeUnit: quotaMinute}, 3},
+		{product.AuthorizedOperation{ID: id2, APIProduct: "p1", QuotaLimit: 10, QuotaInterval: 1, QuotaTimeUnit: quotaMinute}, 1},
+		{product.AuthorizedOperation{ID: id3, APIProduct: "p2", QuotaLimit: 10, QuotaInterval: 1, QuotaTimeUnit: quotaMinute}, 2},
+	}
+
+	key := []byte("secret")
+	hash := func(id string) string { return hashIdentifier(key, id) }
+
+	tests := []struct {
+		mode MetricsMode
+		want map[string]float64
+	}{
+		{MetricsByIdentifier, map[string]float64{id1: 3, id2: 1, id3: 2}},
+		{MetricsByHash, map[string]float64{hash(id1): 3, hash(id2): 1, hash(id3): 2}},
+		{MetricsByProduct, map[string]float64{"p1": 4, "p2": 2}},
+		{MetricsTopBuckets, map[string]float64{hash(id1): 3, hash(id3): 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode.String(), func(t *testing.T) {
+			context := authtest.NewContext("http://localhost")
+			context.SetOrganization("org")
+			context.SetEnvironment("env")
+			authContext := &auth.Context{Context: context}
+
+			reg := prometheus.NewRegistry()
+			opts := Options{
+				Client:         http.DefaultClient,
+				BaseURL:        context.InternalAPI(),
+				Org:            "org",
+				Metrics:        util.MetricsOptions{Registerer: reg},
+				MetricsMode:    test.mode,
+				MetricsTopN:    2,
+				MetricsHashKey: key,
+			}
+			if err := opts.validate(); err != nil {
+				t.Fatal(err)
+			}
+			m := newManager(opts)
+
+			for _, o := range ops {
+				if _, err := m.Apply(authContext, o.op, Args{QuotaAmount: o.weight}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m.reportMetrics()
+
+			if got := quotaValues(t, reg); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want %v, got %v", test.want, got)
+			}
+
+			if test.mode == MetricsTopBuckets {
+				// id2 passes id3, which is no longer reported
+				if _, err := m.Apply(authContext, ops[1].op, Args{QuotaAmount: 4}); err != nil {
+					t.Fatal(err)
+				}
+				m.reportMetrics()
+				want := map[string]float64{hash(id2): 5, hash(id1): 3}
+				if got := quotaValues(t, reg); !reflect.DeepEqual(got, want) {
+					t.Errorf("want %v, got %v", want, got)
+				}
+			}
+		})
+	}
+
+	opts := Options{
+		Client:      http.DefaultClient,
+		BaseURL:     authtest.NewContext("http://localhost").InternalAPI(),
+		Org:         "org",
+		MetricsMode: MetricsTopBuckets + 1,
+	}
+	if err := opts.validate(); err == nil {
+		t.Errorf("want error for invalid metrics mode")
+	}
+}
+
+// quotaValues returns quota_value by "quota" label
+func quotaValues(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "quota_value" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "quota" {
+					values[l.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+
+	"github.com/apigee/apigee-remote-service-golib/v2/auth"
+	"github.com/apigee/apigee-remote-service-golib/v2/product"
+)
+
+// ContextApplier is implemented by a Manager that checks a context before
+// applying quotas. A Manager from NewManager implements it.
+type ContextApplier interface {
+	// ApplyWithContext is Apply, but returns ctx's error if ctx is done
+	ApplyWithContext(ctx context.Context, authContext *auth.Context, o product.AuthorizedOperation, args Args) (*Result, error)
+}
+
+// ApplyWithContext calls m.ApplyWithContext if m is a ContextApplier.
+// Otherwise, it calls m.Apply unless ctx is done.
+func ApplyWithContext(ctx context.Context, m Manager, authContext *auth.Context, o product.AuthorizedOperation, args Args) (*Result, error) {
+	if ca, ok := m.(ContextApplier); ok {
+		return ca.ApplyWithContext(ctx, authContext, o, args)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Apply(authContext, o, args)
+}
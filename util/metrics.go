@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"github.com/apigee/apigee-remote-service-golib/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsOptions determines where and how a manager registers its metrics.
+type MetricsOptions struct {
+	// Registerer for metrics, defaults to prometheus.DefaultRegisterer
+	Registerer prometheus.Registerer
+	// Namespace, if set, prefixes all metric names
+	Namespace string
+	// ConstLabels are added to all metrics
+	ConstLabels prometheus.Labels
+}
+
+// NewGaugeVec creates and registers a GaugeVec. If an identical GaugeVec is
+// already registered, such as by another manager using the same Registerer,
+// the existing GaugeVec is returned so the managers share it.
+func (o MetricsOptions) NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
+	opts.Namespace = o.Namespace
+	opts.ConstLabels = o.ConstLabels
+	gauge := prometheus.NewGaugeVec(opts, labelNames)
+	if existing, ok := o.register(gauge, opts.Subsystem, opts.Name).(*prometheus.GaugeVec); ok {
+		return existing
+	}
+	return gauge
+}
+
+// NewCounterVec creates and registers a CounterVec. If an identical
+// CounterVec is already registered, the existing CounterVec is returned.
+func (o MetricsOptions) NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
+	opts.Namespace = o.Namespace
+	opts.ConstLabels = o.ConstLabels
+	counter := prometheus.NewCounterVec(opts, labelNames)
+	if existing, ok := o.register(counter, opts.Subsystem, opts.Name).(*prometheus.CounterVec); ok {
+		return existing
+	}
+	return counter
+}
+
+// register registers c, returning the existing collector if one identical
+// to c is already registered, nil otherwise
+func (o MetricsOptions) register(c prometheus.Collector, subsystem, name string) prometheus.Collector {
+	reg := o.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		log.Errorf("unable to register metric %s: %v", prometheus.BuildFQName(o.Namespace, subsystem, name), err)
+	}
+	return nil
+}
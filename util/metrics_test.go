@@ -0,0 +1,98 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsOptions(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	opts := MetricsOptions{
+		Registerer:  reg,
+		Namespace:   "ns",
+		ConstLabels: prometheus.Labels{"instance": "a"},
+	}
+	gaugeOpts := prometheus.GaugeOpts{
+		Subsystem: "test",
+		Name:      "gauge",
+		Help:      "test gauge",
+	}
+
+	g1 := opts.NewGaugeVec(gaugeOpts, []string{"org"})
+	g2 := opts.NewGaugeVec(gaugeOpts, []string{"org"})
+	if g1 != g2 {
+		t.Errorf("want existing GaugeVec to be reused")
+	}
+	g1.WithLabelValues("org").Set(2)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("want 1 metric family, got %d", len(families))
+	}
+	if got := families[0].GetName(); got != "ns_test_gauge" {
+		t.Errorf("want name ns_test_gauge, got %s", got)
+	}
+	labels := map[string]string{}
+	for _, l := range families[0].GetMetric()[0].GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["instance"] != "a" || labels["org"] != "org" {
+		t.Errorf("want instance and org labels, got %v", labels)
+	}
+
+	// a conflicting registration is returned unregistered
+	g3 := opts.NewGaugeVec(gaugeOpts, []string{"env"})
+	if g3 == g1 {
+		t.Errorf("want new GaugeVec for conflicting labels")
+	}
+	g3.WithLabelValues("env").Set(1)
+}
+
+func TestMetricsOptionsCounter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	opts := MetricsOptions{
+		Registerer: reg,
+		Namespace:  "ns",
+	}
+	counterOpts := prometheus.CounterOpts{
+		Subsystem: "test",
+		Name:      "counter_total",
+		Help:      "test counter",
+	}
+
+	c1 := opts.NewCounterVec(counterOpts, []string{"org"})
+	c2 := opts.NewCounterVec(counterOpts, []string{"org"})
+	if c1 != c2 {
+		t.Errorf("want existing CounterVec to be reused")
+	}
+	c1.WithLabelValues("org").Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "ns_test_counter_total" {
+		t.Fatalf("want ns_test_counter_total, got %v", families)
+	}
+	if got := families[0].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("want 1, got %v", got)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/apigee/apigee-remote-service-golib/v2"
+
+// Span attribute keys
+const (
+	OrgAttribute = attribute.Key("apigee.org")
+	EnvAttribute = attribute.Key("apigee.env")
+)
+
+// Tracer returns a Tracer from tp for the named package.
+// If tp is nil, the returned Tracer does nothing.
+func Tracer(tp trace.TracerProvider, pkg string) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(instrumentationName + "/" + pkg)
+}
+
+// OrgEnv returns span attributes for org and env, empty values are omitted.
+func OrgEnv(org, env string) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if org != "" {
+		attrs = append(attrs, OrgAttribute.String(org))
+	}
+	if env != "" {
+		attrs = append(attrs, EnvAttribute.String(env))
+	}
+	return attrs
+}
+
+// InjectTraceContext adds the trace context of ctx to the outbound request
+// headers using the global propagator.
+func InjectTraceContext(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// EndSpan records err, if any, and ends span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}